@@ -0,0 +1,99 @@
+package main
+
+// The CPU cannot use VRAM while the PPU is drawing (mode 3), or OAM while
+// the PPU is scanning or drawing (modes 2 and 3). Reads return 0xFF and
+// writes are ignored. Some homebrew gets away with sloppy timing on other
+// emulators, so the restrictions (and the OAM bug below) can be turned off
+// for debugging
+
+// true if the CPU cannot access an address in the current PPU mode
+func (gbppu *ppu) blocks(address uint16) bool {
+	if !gbppu.restrictAccess || !isBitSet(gbppu.read(gbppu.LCDC), 7) {
+		return false
+	}
+	switch {
+	case address >= 0x8000 && address < 0xA000:
+		return gbppu.mode == MODE_DRAW
+	case address >= OAM_START && address < OAM_END:
+		return gbppu.mode == MODE_OAM || gbppu.mode == MODE_DRAW
+	}
+	return false
+}
+
+// switch the access restrictions on or off
+func (gbppu *ppu) toggleAccessRestrictions() {
+	gbppu.restrictAccess = !gbppu.restrictAccess
+	debugLog("Toggled VRAM/OAM access restrictions\n", DEBUG_INFO)
+}
+
+// The DMG corrupts OAM if the CPU puts an address in 0xFE00-0xFEFF on the
+// bus during mode 2, either by accessing it or through a 16-bit register
+// increment or decrement. OAM is 20 rows of 8 bytes and the PPU reads one
+// row per M-cycle of mode 2, so the row being read gets mixed with the row
+// before it. a is the first word of the current row, b and c the first and
+// third words of the previous row. The rest of the current row is copied
+// from the previous row.
+//
+// A read in the same cycle as an increment or decrement (ld a,(hl+), each
+// byte of a pop or ret) first mixes the previous row with the rows either
+// side of it and copies the result over both, then suffers the normal read
+// corruption. Pushes, calls and rsts corrupt once, on the stack pointer
+// decrement. Each access is corrupted in one place only, so instructions
+// that corrupt OAM their own way use fetchUncorrupted and storeUncorrupted
+const (
+	OAM_CORRUPT_WRITE = iota //increment, decrement or write
+	OAM_CORRUPT_READ
+	OAM_CORRUPT_INCREMENT_READ
+)
+
+func (gbppu *ppu) corruptOAM(address uint16, access int) {
+	if gbcgb.enabled || !gbppu.restrictAccess || gbppu.mode != MODE_OAM {
+		return
+	}
+	if address < OAM_START || address > 0xFEFF || !isBitSet(gbppu.read(gbppu.LCDC), 7) {
+		return
+	}
+	row := gbppu.dot / 4
+	if row == 0 || row >= 20 {
+		return
+	}
+
+	if access == OAM_CORRUPT_INCREMENT_READ {
+		//doesn't happen in the first four rows or the last one
+		if row >= 4 && row < 19 {
+			a := oamWord(row-2, 0)
+			b := oamWord(row-1, 0)
+			c := oamWord(row, 0)
+			d := oamWord(row-2, 2)
+			setOamWord(row-1, 0, (b&(a|c|d))|(a&c&d))
+			for word := uint16(0); word < 4; word++ {
+				setOamWord(row, word, oamWord(row-1, word))
+				setOamWord(row-2, word, oamWord(row-1, word))
+			}
+		}
+		access = OAM_CORRUPT_READ
+	}
+
+	a := oamWord(row, 0)
+	b := oamWord(row-1, 0)
+	c := oamWord(row-1, 2)
+	if access == OAM_CORRUPT_READ {
+		setOamWord(row, 0, b|(a&c))
+	} else {
+		setOamWord(row, 0, ((a^c)&(b^c))^c)
+	}
+	for word := uint16(1); word < 4; word++ {
+		setOamWord(row, word, oamWord(row-1, word))
+	}
+}
+
+func oamWord(row, word uint16) uint16 {
+	address := OAM_START + row*8 + word*2
+	return makeWord(gbmmu.memory[address+1], gbmmu.memory[address])
+}
+
+func setOamWord(row, word uint16, value uint16) {
+	address := OAM_START + row*8 + word*2
+	gbmmu.memory[address] = getlsb(value)
+	gbmmu.memory[address+1] = getmsb(value)
+}
@@ -0,0 +1,596 @@
+package main
+
+// Audio processing unit. Four channels - two pulse (square) waves, the
+// first with a frequency sweep, a wave channel playing 32 4-bit samples
+// from wave RAM, and a noise channel - are mixed into stereo by NR50 and
+// NR51. Channel timers run from the 4194304 Hz dot clock; length, envelope
+// and sweep are clocked by the 512 Hz frame sequencer, which is driven from
+// the timer's divider so writes to DIV affect it as on the real hardware
+
+// sound registers
+const (
+	NR10 uint16 = 0xFF10 + iota
+	NR11
+	NR12
+	NR13
+	NR14
+	_
+	NR21
+	NR22
+	NR23
+	NR24
+	NR30
+	NR31
+	NR32
+	NR33
+	NR34
+	_
+	NR41
+	NR42
+	NR43
+	NR44
+	NR50
+	NR51
+	NR52
+)
+
+const WAVE_RAM uint16 = 0xFF30
+const APU_END uint16 = 0xFF40
+
+// bits that always read back as 1, for each register from NR10 to 0xFF2F
+var APU_READ_MASK = [0x20]byte{
+	0x80, 0x3F, 0x00, 0xFF, 0xBF, //NR10-NR14
+	0xFF, 0x3F, 0x00, 0xFF, 0xBF, //NR21-NR24
+	0x7F, 0xFF, 0x9F, 0xFF, 0xBF, //NR30-NR34
+	0xFF, 0xFF, 0x00, 0x00, 0xBF, //NR41-NR44
+	0x00, 0x00, 0x70, //NR50-NR52
+	0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+}
+
+// the APU makes a stereo sample every APU_SAMPLE_DOTS dots, for the audio
+// output to resample to the host's rate
+const APU_SAMPLE_DOTS = 32
+const APU_SAMPLE_RATE = CLOCK_SPEED / APU_SAMPLE_DOTS
+
+// keep at most a second of samples if nothing is taking them
+const APU_BUFFER_LIMIT = APU_SAMPLE_RATE * 2
+
+// pulse wave patterns for 12.5%, 25%, 50% and 75% duty, played from bit 7 down
+var DUTY_PATTERNS = [4]byte{0b00000001, 0b10000001, 0b10000111, 0b01111110}
+
+// noise timer divisors for NR43 bits 0-2
+var NOISE_DIVISORS = [8]int{8, 16, 32, 48, 64, 80, 96, 112}
+
+// length counter, shared by all channels. Counts down to 0 at 256 Hz when
+// enabled, then silences the channel
+type lengthCounter struct {
+	value   int
+	enabled bool
+}
+
+func (length *lengthCounter) clock(enabled *bool) {
+	if length.enabled && length.value > 0 {
+		length.value--
+		if length.value == 0 {
+			*enabled = false
+		}
+	}
+}
+
+// volume envelope for the pulse and noise channels. Moves the volume one
+// step up or down every period 64 Hz ticks
+type envelope struct {
+	initial byte
+	up      bool
+	period  byte
+	timer   byte
+	volume  byte
+}
+
+func (env *envelope) write(value byte) {
+	env.initial = value >> 4
+	env.up = isBitSet(value, 3)
+	env.period = value & 7
+}
+
+func (env *envelope) trigger() {
+	env.volume = env.initial
+	env.timer = env.period
+}
+
+func (env *envelope) clock() {
+	if env.period == 0 {
+		return
+	}
+	if env.timer > 0 {
+		env.timer--
+	}
+	if env.timer == 0 {
+		env.timer = env.period
+		if env.up && env.volume < 15 {
+			env.volume++
+		} else if !env.up && env.volume > 0 {
+			env.volume--
+		}
+	}
+}
+
+type pulseChannel struct {
+	enabled    bool
+	dacEnabled bool
+	length     lengthCounter
+	envelope   envelope
+	duty       byte
+	dutyStep   byte //position in the duty pattern
+	frequency  uint16
+	timer      int
+	//sweep, channel 1 only
+	sweepPeriod  byte
+	sweepDown    bool
+	sweepShift   byte
+	sweepTimer   byte
+	sweepEnabled bool
+	shadow       uint16
+	negateUsed   bool //a subtraction was made since the last trigger
+}
+
+func (ch *pulseChannel) period() int {
+	return int(2048-ch.frequency) * 4
+}
+
+func (ch *pulseChannel) step(dots int) {
+	ch.timer -= dots
+	for ch.timer <= 0 {
+		ch.timer += ch.period()
+		ch.dutyStep = (ch.dutyStep + 1) & 7
+	}
+}
+
+// get the channel's output level (0-15)
+func (ch *pulseChannel) output() byte {
+	if !ch.enabled {
+		return 0
+	}
+	return (DUTY_PATTERNS[ch.duty] >> (7 - ch.dutyStep) & 1) * ch.envelope.volume
+}
+
+func (ch *pulseChannel) trigger(sweep bool) {
+	ch.enabled = ch.dacEnabled
+	if ch.length.value == 0 {
+		ch.length.value = 64
+	}
+	ch.timer = ch.period()
+	ch.envelope.trigger()
+	if sweep {
+		ch.shadow = ch.frequency
+		ch.sweepTimer = ch.sweepReload()
+		ch.sweepEnabled = ch.sweepPeriod != 0 || ch.sweepShift != 0
+		ch.negateUsed = false
+		if ch.sweepShift != 0 {
+			ch.sweepFrequency()
+		}
+	}
+}
+
+// the sweep timer treats a period of 0 as 8
+func (ch *pulseChannel) sweepReload() byte {
+	if ch.sweepPeriod == 0 {
+		return 8
+	}
+	return ch.sweepPeriod
+}
+
+// work out the next sweep frequency, turning the channel off if it overflows
+func (ch *pulseChannel) sweepFrequency() uint16 {
+	delta := ch.shadow >> ch.sweepShift
+	if ch.sweepDown {
+		ch.negateUsed = true
+		return ch.shadow - delta
+	}
+	frequency := ch.shadow + delta
+	if frequency > 2047 {
+		ch.enabled = false
+	}
+	return frequency
+}
+
+// clock the sweep at 128 Hz
+func (ch *pulseChannel) clockSweep() {
+	if ch.sweepTimer > 0 {
+		ch.sweepTimer--
+	}
+	if ch.sweepTimer != 0 {
+		return
+	}
+	ch.sweepTimer = ch.sweepReload()
+	if !ch.sweepEnabled || ch.sweepPeriod == 0 {
+		return
+	}
+	frequency := ch.sweepFrequency()
+	if frequency <= 2047 && ch.sweepShift != 0 {
+		ch.shadow = frequency
+		ch.frequency = frequency
+		//the new frequency is checked for overflow straight away as well
+		ch.sweepFrequency()
+	}
+}
+
+type waveChannel struct {
+	enabled    bool
+	dacEnabled bool
+	length     lengthCounter
+	volume     byte //NR32 bits 5-6: mute, 100%, 50%, 25%
+	frequency  uint16
+	timer      int
+	position   byte //sample 0-31 in wave RAM
+}
+
+func (ch *waveChannel) period() int {
+	return int(2048-ch.frequency) * 2
+}
+
+func (ch *waveChannel) step(dots int) {
+	ch.timer -= dots
+	for ch.timer <= 0 {
+		ch.timer += ch.period()
+		ch.position = (ch.position + 1) & 31
+	}
+}
+
+// get the channel's output level (0-15). Samples are played high nibble first
+func (ch *waveChannel) output(waveRAM []byte) byte {
+	if !ch.enabled || ch.volume == 0 {
+		return 0
+	}
+	sample := waveRAM[ch.position/2]
+	if ch.position&1 == 0 {
+		sample >>= 4
+	}
+	return (sample & 0x0F) >> (ch.volume - 1)
+}
+
+func (ch *waveChannel) trigger() {
+	ch.enabled = ch.dacEnabled
+	if ch.length.value == 0 {
+		ch.length.value = 256
+	}
+	ch.timer = ch.period()
+	ch.position = 0
+}
+
+type noiseChannel struct {
+	enabled    bool
+	dacEnabled bool
+	length     lengthCounter
+	envelope   envelope
+	shift      byte
+	narrow     bool //7 bit LFSR instead of 15
+	divisor    byte
+	timer      int
+	lfsr       uint16
+}
+
+func (ch *noiseChannel) period() int {
+	return NOISE_DIVISORS[ch.divisor] << ch.shift
+}
+
+func (ch *noiseChannel) step(dots int) {
+	ch.timer -= dots
+	for ch.timer <= 0 {
+		ch.timer += ch.period()
+		//shift right, feeding the XOR of the low 2 bits into bit 14 (and bit 6 in 7 bit mode)
+		feedback := (ch.lfsr ^ ch.lfsr>>1) & 1
+		ch.lfsr = ch.lfsr>>1 | feedback<<14
+		if ch.narrow {
+			ch.lfsr = ch.lfsr&^(1<<6) | feedback<<6
+		}
+	}
+}
+
+func (ch *noiseChannel) output() byte {
+	if !ch.enabled || ch.lfsr&1 != 0 {
+		return 0
+	}
+	return ch.envelope.volume
+}
+
+func (ch *noiseChannel) trigger() {
+	ch.enabled = ch.dacEnabled
+	if ch.length.value == 0 {
+		ch.length.value = 64
+	}
+	ch.timer = ch.period()
+	ch.envelope.trigger()
+	ch.lfsr = 0x7FFF
+}
+
+type apu struct {
+	power     bool
+	registers [0x30]byte //NR10 to the end of wave RAM, as written
+	pulse1    pulseChannel
+	pulse2    pulseChannel
+	wave      waveChannel
+	noise     noiseChannel
+	sequencer byte //frame sequencer step 0-7
+	//output
+	sampleDots int
+	samples    []float32 //interleaved left and right, -1 to 1
+	capacitor  [2]float32
+	levels     [4]float32 //each channel's last DAC output, -1 to 1
+	//each channel's part of the mix, interleaved like samples, for stem recordings
+	keepStems      bool
+	stems          [4][]float32
+	stemCapacitors [4][2]float32
+}
+
+var gbapu apu
+
+func (gbapu *apu) initialise() {
+	*gbapu = apu{}
+	gbapu.noise.lfsr = 0x7FFF
+	//the boot ROM leaves the APU on with channel 1 used for the start up sound
+	gbapu.write(NR52, 0x80)
+	gbapu.write(NR50, 0x77)
+	gbapu.write(NR51, 0xF3)
+}
+
+// check whether an address is a sound register or wave RAM
+func isAPUAddress(address uint16) bool {
+	return address >= NR10 && address < APU_END
+}
+
+func (gbapu *apu) waveRAM() []byte {
+	return gbapu.registers[WAVE_RAM-NR10:]
+}
+
+func (gbapu *apu) read(address uint16) byte {
+	offset := address - NR10
+	if address >= WAVE_RAM {
+		return gbapu.registers[offset]
+	}
+	if address == NR52 {
+		value := byte(0x70)
+		if gbapu.power {
+			value |= 0x80
+		}
+		for n, enabled := range []bool{gbapu.pulse1.enabled, gbapu.pulse2.enabled, gbapu.wave.enabled, gbapu.noise.enabled} {
+			if enabled {
+				value |= 1 << n
+			}
+		}
+		return value
+	}
+	return gbapu.registers[offset] | APU_READ_MASK[offset]
+}
+
+func (gbapu *apu) write(address uint16, value byte) {
+	if address >= WAVE_RAM {
+		gbapu.registers[address-NR10] = value
+		return
+	}
+	if address == NR52 {
+		gbapu.setPower(isBitSet(value, 7))
+		return
+	}
+	//the other registers can't be written while the APU is off
+	if !gbapu.power {
+		return
+	}
+	gbapu.registers[address-NR10] = value
+
+	switch address {
+	case NR10:
+		gbapu.pulse1.sweepPeriod = value >> 4 & 7
+		gbapu.pulse1.sweepDown = isBitSet(value, 3)
+		gbapu.pulse1.sweepShift = value & 7
+		//leaving subtraction mode after using it turns the channel off
+		if !gbapu.pulse1.sweepDown && gbapu.pulse1.negateUsed {
+			gbapu.pulse1.enabled = false
+		}
+	case NR11:
+		gbapu.pulse1.duty = value >> 6
+		gbapu.pulse1.length.value = 64 - int(value&0x3F)
+	case NR12:
+		writeEnvelope(&gbapu.pulse1.envelope, &gbapu.pulse1.enabled, &gbapu.pulse1.dacEnabled, value)
+	case NR13:
+		gbapu.pulse1.frequency = gbapu.pulse1.frequency&0x700 | uint16(value)
+	case NR14:
+		gbapu.pulse1.frequency = gbapu.pulse1.frequency&0xFF | uint16(value&7)<<8
+		gbapu.pulse1.length.enabled = isBitSet(value, 6)
+		if isBitSet(value, 7) {
+			gbapu.pulse1.trigger(true)
+		}
+	case NR21:
+		gbapu.pulse2.duty = value >> 6
+		gbapu.pulse2.length.value = 64 - int(value&0x3F)
+	case NR22:
+		writeEnvelope(&gbapu.pulse2.envelope, &gbapu.pulse2.enabled, &gbapu.pulse2.dacEnabled, value)
+	case NR23:
+		gbapu.pulse2.frequency = gbapu.pulse2.frequency&0x700 | uint16(value)
+	case NR24:
+		gbapu.pulse2.frequency = gbapu.pulse2.frequency&0xFF | uint16(value&7)<<8
+		gbapu.pulse2.length.enabled = isBitSet(value, 6)
+		if isBitSet(value, 7) {
+			gbapu.pulse2.trigger(false)
+		}
+	case NR30:
+		gbapu.wave.dacEnabled = isBitSet(value, 7)
+		if !gbapu.wave.dacEnabled {
+			gbapu.wave.enabled = false
+		}
+	case NR31:
+		gbapu.wave.length.value = 256 - int(value)
+	case NR32:
+		gbapu.wave.volume = value >> 5 & 3
+	case NR33:
+		gbapu.wave.frequency = gbapu.wave.frequency&0x700 | uint16(value)
+	case NR34:
+		gbapu.wave.frequency = gbapu.wave.frequency&0xFF | uint16(value&7)<<8
+		gbapu.wave.length.enabled = isBitSet(value, 6)
+		if isBitSet(value, 7) {
+			gbapu.wave.trigger()
+		}
+	case NR41:
+		gbapu.noise.length.value = 64 - int(value&0x3F)
+	case NR42:
+		writeEnvelope(&gbapu.noise.envelope, &gbapu.noise.enabled, &gbapu.noise.dacEnabled, value)
+	case NR43:
+		gbapu.noise.shift = value >> 4
+		gbapu.noise.narrow = isBitSet(value, 3)
+		gbapu.noise.divisor = value & 7
+	case NR44:
+		gbapu.noise.length.enabled = isBitSet(value, 6)
+		if isBitSet(value, 7) {
+			gbapu.noise.trigger()
+		}
+	}
+}
+
+// write NRx2 for a pulse or noise channel. The top 5 bits switch the
+// channel's DAC on, and turning the DAC off turns the channel off
+func writeEnvelope(env *envelope, enabled *bool, dacEnabled *bool, value byte) {
+	env.write(value)
+	*dacEnabled = value&0xF8 != 0
+	if !*dacEnabled {
+		*enabled = false
+	}
+}
+
+// turn the APU on or off. Turning it off clears all the registers except
+// wave RAM, and turning it on restarts the frame sequencer
+func (gbapu *apu) setPower(on bool) {
+	if on == gbapu.power {
+		return
+	}
+	if !on {
+		for address := NR10; address < NR52; address++ {
+			gbapu.write(address, 0)
+		}
+		gbapu.pulse1, gbapu.pulse2 = pulseChannel{}, pulseChannel{}
+		gbapu.wave = waveChannel{}
+		gbapu.noise = noiseChannel{lfsr: 0x7FFF}
+	}
+	gbapu.power = on
+	gbapu.sequencer = 0
+}
+
+// advance the frame sequencer, called at 512 Hz from the divider. Length
+// counters are clocked on even steps, sweep on steps 2 and 6 and the
+// envelopes on step 7
+func (gbapu *apu) frameSequencer() {
+	if !gbapu.power {
+		return
+	}
+	switch gbapu.sequencer {
+	case 2, 6:
+		gbapu.pulse1.clockSweep()
+		fallthrough
+	case 0, 4:
+		gbapu.pulse1.length.clock(&gbapu.pulse1.enabled)
+		gbapu.pulse2.length.clock(&gbapu.pulse2.enabled)
+		gbapu.wave.length.clock(&gbapu.wave.enabled)
+		gbapu.noise.length.clock(&gbapu.noise.enabled)
+	case 7:
+		gbapu.pulse1.envelope.clock()
+		gbapu.pulse2.envelope.clock()
+		gbapu.noise.envelope.clock()
+	}
+	gbapu.sequencer = (gbapu.sequencer + 1) & 7
+}
+
+// advance the channels by a number of dots, making samples as it goes
+func (gbapu *apu) step(dots uint16) {
+	remaining := int(dots)
+	for remaining > 0 {
+		run := APU_SAMPLE_DOTS - gbapu.sampleDots
+		if run > remaining {
+			run = remaining
+		}
+		if gbapu.power {
+			gbapu.pulse1.step(run)
+			gbapu.pulse2.step(run)
+			gbapu.wave.step(run)
+			gbapu.noise.step(run)
+		}
+		gbapu.sampleDots += run
+		remaining -= run
+		if gbapu.sampleDots == APU_SAMPLE_DOTS {
+			gbapu.sampleDots = 0
+			gbapu.sample()
+		}
+	}
+}
+
+// mix the channels into a stereo sample. Each channel's DAC turns its
+// level (0-15) into -1 to 1, or 0 when the DAC is off. NR51 routes the
+// channels to each side and NR50 sets each side's volume (1-8 eighths).
+// Muted channels are left out. When recording stems, each channel's share
+// of the mix is kept as well
+func (gbapu *apu) sample() {
+	outputs := [4]byte{gbapu.pulse1.output(), gbapu.pulse2.output(), gbapu.wave.output(gbapu.waveRAM()), gbapu.noise.output()}
+	dacs := [4]bool{gbapu.pulse1.dacEnabled, gbapu.pulse2.dacEnabled, gbapu.wave.dacEnabled, gbapu.noise.dacEnabled}
+	for n := range outputs {
+		gbapu.levels[n] = 0
+		if dacs[n] {
+			gbapu.levels[n] = float32(outputs[n])/7.5 - 1
+		}
+	}
+	gbchannels.capture(&gbapu.levels)
+	nr50, nr51 := gbapu.registers[NR50-NR10], gbapu.registers[NR51-NR10]
+	volumes := [2]float32{float32(nr50>>4&7+1) / 8 / 4, float32(nr50&7+1) / 8 / 4}
+	var mixed [2]float32
+	for n, level := range gbapu.levels {
+		if !gbchannels.audible(n) {
+			level = 0
+		}
+		var panned [2]float32
+		if isBitSet(nr51, n+4) {
+			panned[0] = level * volumes[0]
+		}
+		if isBitSet(nr51, n) {
+			panned[1] = level * volumes[1]
+		}
+		mixed[0] += panned[0]
+		mixed[1] += panned[1]
+		//the stem capacitors always run, so a stem recording started
+		//part way through matches the mix from its first sample
+		highPass(&panned, &gbapu.stemCapacitors[n])
+		if gbapu.keepStems {
+			gbapu.stems[n] = append(gbapu.stems[n], panned[0], panned[1])
+		}
+	}
+	highPass(&mixed, &gbapu.capacitor)
+
+	if len(gbapu.samples) >= APU_BUFFER_LIMIT {
+		//nobody is listening, so drop the oldest half
+		gbapu.samples = append(gbapu.samples[:0], gbapu.samples[len(gbapu.samples)/2:]...)
+	}
+	gbapu.samples = append(gbapu.samples, mixed[0], mixed[1])
+	if (gbaudio.sink != nil || len(audioRecorders) > 0) && len(gbapu.samples) >= AUDIO_BLOCK*2 {
+		gbapu.flush()
+	}
+}
+
+// the output capacitor removes the DC offset the DACs add, decaying
+// towards the signal by the same factor the real one would in a sample's time
+const APU_HIGH_PASS = 0.998657 //0.999958 per dot, to the power of APU_SAMPLE_DOTS
+
+func highPass(mixed *[2]float32, capacitor *[2]float32) {
+	for side := range mixed {
+		in := mixed[side]
+		mixed[side] = in - capacitor[side]
+		capacitor[side] = in - mixed[side]*APU_HIGH_PASS
+	}
+}
+
+// pass the samples made so far to the audio output and any recordings
+func (gbapu *apu) flush() {
+	gbaudio.play(gbapu.samples)
+	for _, recorder := range audioRecorders {
+		recorder.record(gbapu.samples, &gbapu.stems)
+	}
+	gbapu.samples = gbapu.samples[:0]
+	for n := range gbapu.stems {
+		gbapu.stems[n] = gbapu.stems[n][:0]
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// AudioSink receives the emulator's sound as interleaved stereo 16-bit
+// samples at the sink's rate. Queued reports how many sample frames are
+// waiting to be heard, for rate control - sinks that aren't played in real
+// time return -1
+type AudioSink interface {
+	Play(samples []int16)
+	Queued() int
+	Close() error
+}
+
+// output rates the resampler is set up for
+const AUDIO_RATE_44K = 44100
+const AUDIO_RATE_48K = 48000
+
+// real time output aims to keep this much sound queued, and holds the
+// emulator back when there is more than AUDIO_MAX_LATENCY
+const AUDIO_LATENCY = 60 * time.Millisecond
+const AUDIO_MAX_LATENCY = 2 * AUDIO_LATENCY
+
+// the most rate control will speed up or slow down the sound, as a fraction
+const AUDIO_MAX_ADJUST = 0.005
+
+// the APU's samples are passed on in blocks of this many sample frames
+const AUDIO_BLOCK = APU_SAMPLE_RATE / 100
+
+// audio output - resamples the APU output for the sink
+type audio struct {
+	sink      AudioSink
+	rate      int
+	resampler *resampler
+	output    []int16
+}
+
+var gbaudio audio
+
+// start sending sound to a sink at a sample rate
+func (gbaudio *audio) open(sink AudioSink, rate int) {
+	gbaudio.sink = sink
+	gbaudio.rate = rate
+	gbaudio.resampler = newResampler(APU_SAMPLE_RATE, rate)
+}
+
+func (gbaudio *audio) close() error {
+	if gbaudio.sink == nil {
+		return nil
+	}
+	err := gbaudio.sink.Close()
+	gbaudio.sink = nil
+	return err
+}
+
+// resample a block of APU output and send it to the sink
+func (gbaudio *audio) play(samples []float32) {
+	if gbaudio.sink == nil {
+		return
+	}
+	gbaudio.rateControl()
+	gbaudio.output = gbaudio.resampler.process(samples, gbaudio.output[:0])
+	gbaudio.sink.Play(gbaudio.output)
+	gbaudio.pace()
+}
+
+// The emulator runs at the speed the window's VSync allows, which is never
+// quite the Game Boy's 59.7 Hz, so the sound would slowly run ahead of or
+// behind the sink. Rate control stretches or squeezes the sound very
+// slightly (too little to hear) to hold the queue near the target latency
+func (gbaudio *audio) rateControl() {
+	queued := gbaudio.sink.Queued()
+	if queued < 0 {
+		gbaudio.resampler.adjust(1)
+		return
+	}
+	target := float64(gbaudio.rate) * AUDIO_LATENCY.Seconds()
+	//too much queued - take input faster so fewer samples come out
+	difference := (float64(queued) - target) / target
+	if difference > 1 {
+		difference = 1
+	} else if difference < -1 {
+		difference = -1
+	}
+	gbaudio.resampler.adjust(1 + AUDIO_MAX_ADJUST*difference)
+}
+
+// Rate control can only make up a fraction of a percent. With VSync above
+// 60 Hz (a 120 or 144 Hz monitor) the emulator runs the Game Boy at twice
+// its speed or more, so the sink is also used as the clock: once more than
+// AUDIO_MAX_LATENCY is queued, the emulator waits for the queue to drain
+// back to the target
+func (gbaudio *audio) pace() {
+	queued := gbaudio.sink.Queued()
+	if queued < 0 || queued <= int(float64(gbaudio.rate)*AUDIO_MAX_LATENCY.Seconds()) {
+		return
+	}
+	target := int(float64(gbaudio.rate) * AUDIO_LATENCY.Seconds())
+	time.Sleep(time.Duration(queued-target) * time.Second / time.Duration(gbaudio.rate))
+}
+
+// choose the audio output from the settings: "none", a .wav file, or "play"
+// through a command that reads raw samples from its input, "aplay" by
+// default. {rate} in the command is replaced with the sample rate. Sound is
+// off unless one of them is configured, as no player works everywhere
+func openAudio(output string, command string, rate int) error {
+	if rate != AUDIO_RATE_44K && rate != AUDIO_RATE_48K {
+		return fmt.Errorf("audio rate must be %d or %d, got %d", AUDIO_RATE_44K, AUDIO_RATE_48K, rate)
+	}
+	if output == "" && command != "" {
+		output = "play"
+	}
+	var sink AudioSink
+	switch {
+	case output == "" || output == "none":
+		sink = nullAudioSink{}
+	case strings.HasSuffix(strings.ToLower(output), ".wav"):
+		writer, err := newWavWriter(output, 2, rate)
+		if err != nil {
+			return err
+		}
+		sink = &wavAudioSink{writer: writer}
+	case output == "play":
+		if command == "" {
+			command = "aplay -q -t raw -f S16_LE -c 2 -r {rate} -"
+		}
+		pipe, err := newPipeAudioSink(strings.ReplaceAll(command, "{rate}", strconv.Itoa(rate)), rate)
+		if err != nil {
+			return err
+		}
+		sink = pipe
+	default:
+		return fmt.Errorf("unknown audio output %q, expected \"none\", \"play\" or a .wav file", output)
+	}
+	gbaudio.open(sink, rate)
+	return nil
+}
+
+// nullAudioSink throws the sound away
+type nullAudioSink struct{}
+
+func (nullAudioSink) Play(samples []int16) {}
+
+func (nullAudioSink) Queued() int {
+	return -1
+}
+
+func (nullAudioSink) Close() error {
+	return nil
+}
+
+// wavAudioSink writes the sound to a WAV file
+type wavAudioSink struct {
+	writer *wavWriter
+	err    error
+}
+
+func (sink *wavAudioSink) Play(samples []int16) {
+	if sink.err == nil {
+		sink.err = sink.writer.write(samples)
+	}
+}
+
+func (sink *wavAudioSink) Queued() int {
+	return -1
+}
+
+func (sink *wavAudioSink) Close() error {
+	return errors.Join(sink.err, sink.writer.close())
+}
+
+// pipeAudioSink plays sound in real time by piping raw samples to a command
+// such as aplay or pacat. The pipe doesn't say how much the player has
+// buffered, so the queue is modelled: the player is taken to play at
+// exactly the sample rate from the first block, starting again whenever the
+// model runs dry. Blocks still waiting to go down the pipe are certainly
+// queued, so the model never reports less than those. Writes happen in the
+// background so a stalled player never holds up the emulator; if it falls
+// too far behind, sound is dropped and the drops are reported
+type pipeAudioSink struct {
+	cmd     *exec.Cmd
+	input   io.WriteCloser
+	blocks  chan []byte
+	done    chan error
+	rate    int
+	sent    int //sample frames sent
+	started time.Time
+	pending atomic.Int64 //sample frames not yet written to the pipe
+	dropped int          //blocks dropped because the player fell behind
+}
+
+// blocks waiting to be written to the player
+const AUDIO_PIPE_BLOCKS = 16
+
+func newPipeAudioSink(command string, rate int) (*pipeAudioSink, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, errors.New("empty audio command")
+	}
+	cmd := exec.Command(fields[0], fields[1:]...)
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start %s: %w", fields[0], err)
+	}
+	sink := &pipeAudioSink{
+		cmd:    cmd,
+		input:  input,
+		blocks: make(chan []byte, AUDIO_PIPE_BLOCKS),
+		done:   make(chan error, 1),
+		rate:   rate,
+	}
+	go sink.writer()
+	return sink, nil
+}
+
+func (sink *pipeAudioSink) writer() {
+	var err error
+	for block := range sink.blocks {
+		if err == nil {
+			_, err = sink.input.Write(block)
+		}
+		sink.pending.Add(-int64(len(block) / 4))
+	}
+	sink.done <- err
+}
+
+func (sink *pipeAudioSink) Play(samples []int16) {
+	if sink.started.IsZero() {
+		sink.started = time.Now()
+	}
+	//if the queue has run dry, the player has been waiting, so start counting again
+	if sink.Queued() == 0 {
+		sink.started = time.Now()
+		sink.sent = 0
+	}
+	block := make([]byte, len(samples)*2)
+	for i, sample := range samples {
+		block[i*2] = byte(sample)
+		block[i*2+1] = byte(uint16(sample) >> 8)
+	}
+	//counted before it is sent, so the writer never takes it off first
+	sink.pending.Add(int64(len(samples) / 2))
+	select {
+	case sink.blocks <- block:
+		sink.sent += len(samples) / 2
+	default:
+		//the player is too far behind, drop this block
+		sink.pending.Add(-int64(len(samples) / 2))
+		if sink.dropped == 0 {
+			fmt.Println("Audio player is not keeping up, dropping sound")
+		}
+		sink.dropped++
+	}
+}
+
+func (sink *pipeAudioSink) Queued() int {
+	if sink.started.IsZero() {
+		return 0
+	}
+	pending := int(sink.pending.Load())
+	played := int(time.Since(sink.started).Seconds() * float64(sink.rate))
+	if queued := sink.sent - played; queued > pending {
+		return queued
+	}
+	return pending
+}
+
+func (sink *pipeAudioSink) Close() error {
+	close(sink.blocks)
+	err := <-sink.done
+	if sink.dropped > 0 {
+		fmt.Printf("Dropped %d blocks of sound\n", sink.dropped)
+	}
+	return errors.Join(err, sink.input.Close(), sink.cmd.Wait())
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+)
+
+// Game Boy Color registers
+const (
+	KEY0 uint16 = 0xFF4C // CGB/DMG compatibility mode, writable by the boot ROM only
+	VBK  uint16 = 0xFF4F // VRAM bank
+	BCPS uint16 = 0xFF68 // background palette index
+	BCPD uint16 = 0xFF69 // background palette data
+	OCPS uint16 = 0xFF6A // object palette index
+	OCPD uint16 = 0xFF6B // object palette data
+	OPRI uint16 = 0xFF6C // object priority mode
+	SVBK uint16 = 0xFF70 // WRAM bank
+)
+
+// cartridge header CGB flag values at 0x0143
+const (
+	CGB_SUPPORTED byte = 0x80
+	CGB_ONLY      byte = 0xC0
+)
+
+type cgb struct {
+	enabled bool // running on CGB hardware
+	compat  bool // running a DMG cartridge on CGB hardware (KEY0 compatibility mode)
+	//palette RAM - 8 palettes of 4 colours, each colour is 2 bytes of little endian RGB555
+	bgPalette  [64]byte
+	objPalette [64]byte
+	bcps, ocps byte
+	opri       byte
+}
+
+var gbcgb cgb
+
+// true when CGB only features (banks, attributes, colour palettes) are available
+func (gbcgb *cgb) active() bool {
+	return gbcgb.enabled && !gbcgb.compat
+}
+
+// choose the hardware to emulate from the config model and the cartridge header
+func (gbcgb *cgb) initialise(model string, cgbFlag byte) {
+	cartridgeCGB := cgbFlag == CGB_SUPPORTED || cgbFlag == CGB_ONLY
+	switch strings.ToLower(model) {
+	case "dmg", "sgb":
+		gbcgb.enabled = false
+	case "cgb":
+		gbcgb.enabled = true
+	default:
+		gbcgb.enabled = cartridgeCGB
+	}
+	gbcgb.compat = gbcgb.enabled && !cartridgeCGB
+	gbcgb.opri = 0
+	if gbcgb.compat {
+		//the boot ROM writes 0x04 to KEY0 and objects use DMG (X coordinate) priority
+		gbcgb.opri = 1
+		gbcgb.loadCompatPalette(gbconfig.CompatPalette)
+	} else {
+		//the boot ROM leaves all background colours white
+		for i := range gbcgb.bgPalette {
+			gbcgb.bgPalette[i] = 0xFF
+		}
+	}
+}
+
+// handle a write to the boot ROM only KEY0 register
+func (gbcgb *cgb) writeKEY0(value byte) {
+	if gbcgb.enabled && gbmmu.memory[0xFF50] == 0 {
+		gbcgb.compat = value&0x0C == 0x04
+	}
+}
+
+// read BCPD/OCPD at the current index
+func (gbcgb *cgb) readPalette(ram *[64]byte, index byte) byte {
+	return ram[index&0x3F]
+}
+
+// write BCPD/OCPD and auto-increment the index if bit 7 of the index register is set
+func (gbcgb *cgb) writePalette(ram *[64]byte, index *byte, value byte) {
+	ram[*index&0x3F] = value
+	if isBitSet(*index, 7) {
+		*index = 0x80 | (*index+1)&0x3F
+	}
+}
+
+// get the RGB555 value of a colour in palette RAM
+func paletteRAMColour(ram *[64]byte, palette, colour byte) uint16 {
+	offset := (palette&7)*8 + (colour&3)*2
+	return makeWord(ram[offset+1], ram[offset]) & 0x7FFF
+}
+
+// set a colour in palette RAM from a RGB555 value
+func setPaletteRAMColour(ram *[64]byte, palette, colour byte, rgb555 uint16) {
+	offset := (palette&7)*8 + (colour&3)*2
+	ram[offset] = getlsb(rgb555)
+	ram[offset+1] = getmsb(rgb555) & 0x7F
+}
+
+// convert RGB555 (5 bits each of red, green then blue from bit 0) to RGB
+func rgb555(value uint16) color.RGBA {
+	expand := func(c uint16) uint8 {
+		return uint8(c<<3 | c>>2)
+	}
+	return color.RGBA{expand(value & 0x1F), expand(value >> 5 & 0x1F), expand(value >> 10 & 0x1F), 255}
+}
+
+// convert RGB to the nearest RGB555 value
+func toRGB555(c color.RGBA) uint16 {
+	return uint16(c.R>>3) | uint16(c.G>>3)<<5 | uint16(c.B>>3)<<10
+}
+
+func (gbcgb *cgb) bgColour(palette, colour byte) color.RGBA {
+	return rgb555(paletteRAMColour(&gbcgb.bgPalette, palette, colour))
+}
+
+func (gbcgb *cgb) objColour(palette, colour byte) color.RGBA {
+	return rgb555(paletteRAMColour(&gbcgb.objPalette, palette, colour))
+}
+
+// Compatibility palettes the CGB boot ROM gives DMG games. The boot ROM
+// picks one from the title checksum, or the player can choose one by
+// holding a button combination while the logo is shown. Colours are in
+// order BG, OBJ0 and OBJ1, lightest first.
+var compatPalettes = map[string][3][4]uint32{
+	"dark green": {
+		{0xFFFFFF, 0x7BFF31, 0x0063C5, 0x000000},
+		{0xFFFFFF, 0xFF8484, 0x943A3A, 0x000000},
+		{0xFFFFFF, 0xFF8484, 0x943A3A, 0x000000},
+	},
+	"brown": {
+		{0xFFFFFF, 0xFFAD63, 0x843100, 0x000000},
+		{0xFFFFFF, 0xFFAD63, 0x843100, 0x000000},
+		{0xFFFFFF, 0xFFAD63, 0x843100, 0x000000},
+	},
+	"grayscale": {
+		{0xFFFFFF, 0xA5A5A5, 0x525252, 0x000000},
+		{0xFFFFFF, 0xA5A5A5, 0x525252, 0x000000},
+		{0xFFFFFF, 0xA5A5A5, 0x525252, 0x000000},
+	},
+	"inverted": {
+		{0x000000, 0x008484, 0xFFDE00, 0xFFFFFF},
+		{0x000000, 0x008484, 0xFFDE00, 0xFFFFFF},
+		{0x000000, 0x008484, 0xFFDE00, 0xFFFFFF},
+	},
+}
+
+const DEFAULT_COMPAT_PALETTE = "dark green"
+
+// load a compatibility palette into palette RAM - BG palette 0 and OBJ palettes 0 and 1
+func (gbcgb *cgb) loadCompatPalette(name string) {
+	palettes, ok := compatPalettes[strings.ToLower(name)]
+	if !ok {
+		if name != "" {
+			fmt.Printf("Unknown compatibility palette %q, using %s\n", name, DEFAULT_COMPAT_PALETTE)
+		}
+		palettes = compatPalettes[DEFAULT_COMPAT_PALETTE]
+	}
+	for colour := byte(0); colour < 4; colour++ {
+		setPaletteRAMColour(&gbcgb.bgPalette, 0, colour, toRGB555(rgb24(palettes[0][colour])))
+		setPaletteRAMColour(&gbcgb.objPalette, 0, colour, toRGB555(rgb24(palettes[1][colour])))
+		setPaletteRAMColour(&gbcgb.objPalette, 1, colour, toRGB555(rgb24(palettes[2][colour])))
+	}
+}
+
+func rgb24(value uint32) color.RGBA {
+	return color.RGBA{uint8(value >> 16), uint8(value >> 8), uint8(value), 255}
+}
@@ -0,0 +1,167 @@
+package main
+
+import "fmt"
+
+// Channel controls mute or solo each APU channel while it keeps running,
+// to pick apart what a sound driver is doing. Muting only changes what is
+// mixed - registers, timers and read-backs carry on as normal. When any
+// channel is soloed, only soloed channels are heard. A trace of each
+// channel's DAC output is also kept for the sound view's oscilloscopes
+
+const (
+	CHANNEL_PULSE1 = iota
+	CHANNEL_PULSE2
+	CHANNEL_WAVE
+	CHANNEL_NOISE
+	CHANNEL_COUNT
+)
+
+var CHANNEL_NAMES = [CHANNEL_COUNT]string{"pulse1", "pulse2", "wave", "noise"}
+
+// the trace keeps every SCOPE_DECIMATE'th sample (32768 Hz), long enough
+// to show a few cycles of the lowest notes
+const SCOPE_DECIMATE = 4
+const SCOPE_LENGTH = 1024
+
+type channels struct {
+	muted  [CHANNEL_COUNT]bool
+	soloed [CHANNEL_COUNT]bool
+	//oscilloscope traces, a ring buffer per channel
+	scope      [CHANNEL_COUNT][SCOPE_LENGTH]float32
+	scopeIndex int
+	scopeSkip  int
+}
+
+var gbchannels channels
+
+// check whether a channel is mixed into the output
+func (gbchannels *channels) audible(channel int) bool {
+	if gbchannels.muted[channel] {
+		return false
+	}
+	for _, soloed := range gbchannels.soloed {
+		if soloed {
+			return gbchannels.soloed[channel]
+		}
+	}
+	return true
+}
+
+func (gbchannels *channels) setMuted(channel int, muted bool) {
+	gbchannels.muted[channel] = muted
+}
+
+func (gbchannels *channels) toggleMute(channel int) {
+	gbchannels.muted[channel] = !gbchannels.muted[channel]
+	fmt.Printf("Channel %s muted: %v\n", CHANNEL_NAMES[channel], gbchannels.muted[channel])
+}
+
+func (gbchannels *channels) setSolo(channel int, soloed bool) {
+	gbchannels.soloed[channel] = soloed
+}
+
+func (gbchannels *channels) toggleSolo(channel int) {
+	gbchannels.soloed[channel] = !gbchannels.soloed[channel]
+	fmt.Printf("Channel %s solo: %v\n", CHANNEL_NAMES[channel], gbchannels.soloed[channel])
+}
+
+// add the channels' latest DAC outputs to the traces
+func (gbchannels *channels) capture(levels *[4]float32) {
+	gbchannels.scopeSkip++
+	if gbchannels.scopeSkip < SCOPE_DECIMATE {
+		return
+	}
+	gbchannels.scopeSkip = 0
+	for channel, level := range levels {
+		gbchannels.scope[channel][gbchannels.scopeIndex] = level
+	}
+	gbchannels.scopeIndex = (gbchannels.scopeIndex + 1) % SCOPE_LENGTH
+}
+
+// get the latest length samples of a channel's trace, oldest first. Like
+// an oscilloscope's trigger, the start is moved back to where the wave
+// last rose through its midpoint, so a steady tone stands still
+func (gbchannels *channels) trace(channel int, length int) []float32 {
+	samples := make([]float32, SCOPE_LENGTH)
+	ring := &gbchannels.scope[channel]
+	copy(samples, ring[gbchannels.scopeIndex:])
+	copy(samples[SCOPE_LENGTH-gbchannels.scopeIndex:], ring[:gbchannels.scopeIndex])
+
+	low, high := samples[0], samples[0]
+	for _, sample := range samples {
+		if sample < low {
+			low = sample
+		}
+		if sample > high {
+			high = sample
+		}
+	}
+	middle := (low + high) / 2
+	for start := SCOPE_LENGTH - length; start > 0; start-- {
+		if samples[start-1] <= middle && samples[start] > middle {
+			return samples[start : start+length]
+		}
+	}
+	return samples[SCOPE_LENGTH-length:]
+}
+
+// what a channel is currently playing
+type channelStatus struct {
+	enabled     bool    //playing, not stopped by its length, sweep or DAC
+	frequency   float64 //of the tone in Hz, or the noise channel's shift rate
+	volume      byte    //0-15 - the envelope, or the wave channel's level as a fraction of 15
+	duty        byte    //pulse duty pattern, 0-3 for 12.5%, 25%, 50% and 75%
+	narrow      bool    //noise channel in 7 bit mode
+	left, right bool    //routed to each side by NR51
+}
+
+var DUTY_NAMES = [4]string{"12.5%", "25%", "50%", "75%"}
+
+// get a channel's status for the read-outs
+func (gbapu *apu) channelStatus(channel int) channelStatus {
+	var status channelStatus
+	switch channel {
+	case CHANNEL_PULSE1, CHANNEL_PULSE2:
+		ch := &gbapu.pulse1
+		if channel == CHANNEL_PULSE2 {
+			ch = &gbapu.pulse2
+		}
+		status.enabled = ch.enabled
+		status.frequency = float64(CLOCK_SPEED) / float64(ch.period()*8)
+		status.volume = ch.envelope.volume
+		status.duty = ch.duty
+	case CHANNEL_WAVE:
+		status.enabled = gbapu.wave.enabled
+		status.frequency = float64(CLOCK_SPEED) / float64(gbapu.wave.period()*32)
+		if gbapu.wave.volume > 0 {
+			status.volume = 15 >> (gbapu.wave.volume - 1)
+		}
+	case CHANNEL_NOISE:
+		status.enabled = gbapu.noise.enabled
+		status.frequency = float64(CLOCK_SPEED) / float64(gbapu.noise.period())
+		status.volume = gbapu.noise.envelope.volume
+		status.narrow = gbapu.noise.narrow
+	}
+	nr51 := gbapu.registers[NR51-NR10]
+	status.left = isBitSet(nr51, channel+4)
+	status.right = isBitSet(nr51, channel)
+	return status
+}
+
+// describe a channel's status in one line
+func (gbapu *apu) describeChannel(channel int) string {
+	status := gbapu.channelStatus(channel)
+	text := fmt.Sprintf("%s %.1f Hz vol %d", CHANNEL_NAMES[channel], status.frequency, status.volume)
+	switch channel {
+	case CHANNEL_PULSE1, CHANNEL_PULSE2:
+		text += " duty " + DUTY_NAMES[status.duty]
+	case CHANNEL_NOISE:
+		if status.narrow {
+			text += " 7 bit"
+		}
+	}
+	if !status.enabled {
+		text += " (off)"
+	}
+	return text
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/color"
+	"os"
+	"strings"
+)
+
+const CONFIG_FILE = "./gbemu.json"
+
+// user settings loaded from CONFIG_FILE, e.g.
+//
+//	{
+//		"colour_scheme": "Custom",
+//		"custom_colours": ["E0F8D0", "88C070", "346856", "081820"],
+//		"model": "cgb",
+//		"compat_palette": "grayscale",
+//		"renderer": "fifo",
+//		"ignore_access_restrictions": false,
+//		"screenshot_dir": "screenshots",
+//		"screenshot_scale": 3,
+//		"record_format": "apng",
+//		"scale": 4,
+//		"filter": "xbr",
+//		"ghosting": 0.5,
+//		"colour_correction": true,
+//		"audio": "play",
+//		"audio_command": "pacat --format=s16le --channels=2 --rate={rate}",
+//		"audio_rate": 44100,
+//		"record_stems": true,
+//		"keys": {"a": "X", "b": "Z", "start": "Enter", "select": "RightShift"}
+//	}
+type config struct {
+	ColourScheme  string   `json:"colour_scheme"`
+	CustomColours []string `json:"custom_colours"`
+	//hardware to emulate - "dmg", "sgb" (SGB features for SGB cartridges, DMG otherwise),
+	//"cgb" or "auto" to match the cartridge
+	Model string `json:"model"`
+	//palette for DMG cartridges running on CGB hardware
+	CompatPalette string `json:"compat_palette"`
+	//"scanline" (default) or "fifo" for the mid-line accurate pixel FIFO renderer
+	Renderer string `json:"renderer"`
+	//let the CPU use VRAM and OAM in any PPU mode, for homebrew with sloppy timing
+	IgnoreAccessRestrictions bool `json:"ignore_access_restrictions"`
+	//where screenshots are saved (default the current folder) and their scale factor
+	ScreenshotDir   string `json:"screenshot_dir"`
+	ScreenshotScale int    `json:"screenshot_scale"`
+	//format for recordings started with the hotkey - "gif" (default), "apng" or "y4m".
+	//They are saved alongside screenshots
+	RecordFormat string `json:"record_format"`
+	//window size as a multiple of the Game Boy screen (default 3) and the filter
+	//used to enlarge it - "nearest", "scale2x", "scale3x", "epx", "xbr" or "lcd"
+	Scale  int    `json:"scale"`
+	Filter string `json:"filter"`
+	//how much of the previous frame to blend into each new one, from 0 (off) to
+	//below 1, like the slow response of the real LCD
+	Ghosting float64 `json:"ghosting"`
+	//adjust CGB colours to look as they did on the GBC screen
+	ColourCorrection bool `json:"colour_correction"`
+	//where sound goes - "none" (the default), a .wav file, or "play" through
+	//audio_command, which reads raw 16-bit stereo samples ("aplay" if not set,
+	//with {rate} replaced by the sample rate). Setting audio_command alone also
+	//plays through it. Rate is 44100 or 48000 (default)
+	Audio        string `json:"audio"`
+	AudioCommand string `json:"audio_command"`
+	AudioRate    int    `json:"audio_rate"`
+	//write each channel to its own WAV file alongside sound recordings
+	RecordStems bool `json:"record_stems"`
+	//keyboard keys for the joypad buttons (right, left, up, down, a, b, select
+	//and start), by their pixelgl names. Buttons left out keep the defaults -
+	//the arrow keys, X, Z, right shift and enter
+	Keys map[string]string `json:"keys"`
+}
+
+var gbconfig config
+
+// load settings from a JSON file. A missing file is not an error and leaves
+// the defaults in place
+func (gbconfig *config) load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, gbconfig); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return gbconfig.apply()
+}
+
+// apply the loaded settings to the emulator. A bad setting keeps its default
+// without stopping the others from being applied, and all the problems are
+// reported together
+func (gbconfig *config) apply() error {
+	var errs []error
+	if len(gbconfig.CustomColours) > 0 {
+		colours, err := parseColours(gbconfig.CustomColours)
+		if err == nil {
+			addColourScheme("Custom", colours)
+		}
+		errs = append(errs, err)
+	}
+	if gbconfig.Scale > 0 {
+		displayScale = gbconfig.Scale
+	}
+	if gbconfig.Ghosting < 0 || gbconfig.Ghosting >= 1 {
+		errs = append(errs, fmt.Errorf("ghosting must be from 0 to below 1, got %v", gbconfig.Ghosting))
+	} else {
+		gbghosting.persistence = gbconfig.Ghosting
+		gbghosting.enabled = gbconfig.Ghosting > 0
+	}
+	gbcorrection.enabled = gbconfig.ColourCorrection
+	errs = append(errs, bindKeys(gbconfig.Keys))
+	if gbconfig.Filter != "" {
+		errs = append(errs, selectFilter(gbconfig.Filter))
+	}
+	if gbconfig.ColourScheme != "" {
+		errs = append(errs, selectColourScheme(gbconfig.ColourScheme))
+	}
+	return errors.Join(errs...)
+}
+
+// parse four RGB hex strings (lightest first) into colours
+func parseColours(values []string) ([4]color.RGBA, error) {
+	var colours [4]color.RGBA
+	if len(values) != 4 {
+		return colours, fmt.Errorf("custom_colours needs 4 entries, got %d", len(values))
+	}
+	for i, value := range values {
+		rgb, err := hex.DecodeString(strings.TrimPrefix(value, "#"))
+		if err != nil || len(rgb) != 3 {
+			return colours, fmt.Errorf("custom colour %q is not RRGGBB", value)
+		}
+		colours[i] = color.RGBA{rgb[0], rgb[1], rgb[2], 255}
+	}
+	return colours, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigAppliesGoodSettingsPastBadOnes(t *testing.T) {
+	filter, scheme, schemes := currentFilter, currentScheme, colourSchemes
+	t.Cleanup(func() {
+		currentFilter, currentScheme, colourSchemes = filter, scheme, schemes
+		gbcorrection.enabled = false
+	})
+
+	settings := config{
+		Ghosting:         2,
+		ColourCorrection: true,
+		Filter:           "scale2x",
+		ColourScheme:     "pocket grey",
+		CustomColours:    []string{"000000"},
+	}
+	err := settings.apply()
+	if err == nil {
+		t.Fatal("bad settings gave no error")
+	}
+	for _, text := range []string{"ghosting", "custom_colours"} {
+		if !strings.Contains(err.Error(), text) {
+			t.Errorf("error %q doesn't mention %s", err, text)
+		}
+	}
+	if gbghosting.enabled {
+		t.Error("bad ghosting was applied")
+	}
+	if !gbcorrection.enabled {
+		t.Error("colour_correction wasn't applied")
+	}
+	if currentFilter != "scale2x" {
+		t.Errorf("filter is %q, want scale2x", currentFilter)
+	}
+	if colourSchemes[currentScheme].name != "Pocket grey" {
+		t.Errorf("colour scheme is %q, want Pocket grey", colourSchemes[currentScheme].name)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"path/filepath"
+
+	"github.com/faiface/pixel"
+	"github.com/faiface/pixel/pixelgl"
+	"golang.org/x/image/colornames"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Debug views show the PPU's and APU's state in windows of their own,
+// redrawn once a frame. Hovering over a view shows what is under the mouse
+// in the title bar, clicking prints it, and E exports the view as a PNG
+type debugView interface {
+	name() string
+	render() *image.RGBA
+	//describe what is at a point in the rendered image, or "" for nothing
+	describe(x, y int) string
+}
+
+// views can also react to clicks and their own keys
+type debugClicker interface {
+	click(x, y int)
+}
+
+type debugKeyer interface {
+	keys(win *pixelgl.Window)
+}
+
+// debug windows are shown at this multiple of the view size
+const DEBUG_SCALE = 2
+
+type debugWindow struct {
+	view  debugView
+	win   *pixelgl.Window
+	title string
+}
+
+// the open debug windows
+var debugWindows []*debugWindow
+
+// open a view in a new window, or close it if it is already open
+func toggleDebugWindow(view debugView) {
+	for i, window := range debugWindows {
+		if window.view == view {
+			window.win.Destroy()
+			debugWindows = append(debugWindows[:i], debugWindows[i+1:]...)
+			return
+		}
+	}
+	bounds := view.render().Bounds()
+	cfg := pixelgl.WindowConfig{
+		Title:  view.name(),
+		Bounds: pixel.R(0, 0, float64(bounds.Dx()*DEBUG_SCALE), float64(bounds.Dy()*DEBUG_SCALE)),
+		//the main window's VSync paces the emulator, so don't wait here too
+		VSync: false,
+	}
+	win, err := pixelgl.NewWindow(cfg)
+	if err != nil {
+		fmt.Printf("Unable to open %s window: %v\n", view.name(), err)
+		return
+	}
+	debugWindows = append(debugWindows, &debugWindow{view: view, win: win})
+}
+
+// redraw the debug windows and handle their input, closing any the user has closed
+func updateDebugWindows() {
+	open := debugWindows[:0]
+	for _, window := range debugWindows {
+		if window.win.Closed() {
+			window.win.Destroy()
+			continue
+		}
+		window.update()
+		open = append(open, window)
+	}
+	debugWindows = open
+}
+
+func (window *debugWindow) update() {
+	frame := window.view.render()
+	picture := pixel.PictureDataFromImage(frame)
+	window.win.Clear(colornames.Black)
+	sprite := pixel.NewSprite(picture, picture.Bounds())
+	sprite.Draw(window.win, pixel.IM.Scaled(pixel.ZV, DEBUG_SCALE).Moved(window.win.Bounds().Center()))
+	window.win.Update()
+
+	x, y, inside := window.mousePixel(frame.Bounds())
+	title := window.view.name()
+	if inside {
+		if detail := window.view.describe(x, y); detail != "" {
+			title += " - " + detail
+		}
+	}
+	if title != window.title {
+		window.win.SetTitle(title)
+		window.title = title
+	}
+
+	if inside && window.win.JustPressed(pixelgl.MouseButtonLeft) {
+		if clicker, ok := window.view.(debugClicker); ok {
+			clicker.click(x, y)
+		} else if detail := window.view.describe(x, y); detail != "" {
+			fmt.Println(detail)
+		}
+	}
+	if window.win.JustPressed(pixelgl.KeyE) {
+		path, err := exportDebugView(window.view, gbconfig.ScreenshotDir)
+		if err != nil {
+			fmt.Printf("Unable to export %s: %v\n", window.view.name(), err)
+		} else {
+			fmt.Printf("Saved %s\n", path)
+		}
+	}
+	if keyer, ok := window.view.(debugKeyer); ok {
+		keyer.keys(window.win)
+	}
+}
+
+// get the view pixel under the mouse. pixel measures from the bottom left
+func (window *debugWindow) mousePixel(bounds image.Rectangle) (int, int, bool) {
+	position := window.win.MousePosition()
+	offset := window.win.Bounds().Center().Sub(pixel.V(float64(bounds.Dx()*DEBUG_SCALE)/2, float64(bounds.Dy()*DEBUG_SCALE)/2))
+	x := int(position.X-offset.X) / DEBUG_SCALE
+	y := bounds.Dy() - 1 - int(position.Y-offset.Y)/DEBUG_SCALE
+	inside := position.X >= offset.X && position.Y >= offset.Y && x < bounds.Dx() && y >= 0
+	return x, y, inside
+}
+
+// save a view as a PNG in dir, named from the ROM title, view and frame number
+func exportDebugView(view debugView, dir string) (string, error) {
+	name := fmt.Sprintf("%s_%s_%06d.png", fileTitle(gbrom.name()), fileTitle(view.name()), gbppu.frameCount)
+	path := filepath.Join(dir, name)
+	return path, writePNG(path, view.render())
+}
+
+// height of a line of text drawn with drawText
+const DEBUG_LINE_HEIGHT = 13
+
+// draw text in a view with its top left corner at x, y
+func drawText(img *image.RGBA, x, y int, text string, colour color.RGBA) {
+	drawer := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(colour),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y+basicfont.Face7x13.Ascent),
+	}
+	drawer.DrawString(text)
+}
+
+// fill a rectangle in a view
+func fillRect(img *image.RGBA, r image.Rectangle, colour color.RGBA) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetRGBA(x, y, colour)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+// writing XX to the DMA register copies XX00-XX9F to OAM, one byte per
+// M-cycle (4 t-states) while the CPU keeps running
+const DMA uint16 = 0xFF46
+const DMA_LENGTH uint16 = 160
+
+type dma struct {
+	active bool
+	source uint16
+	index  uint16 //next byte to copy
+	//a transfer starts one M-cycle after the write. When restarted, the old
+	//transfer carries on copying during that cycle
+	startDelay uint16
+	nextSource uint16
+}
+
+var gbdma dma
+
+// start (or restart) a transfer from a DMA register write
+func (gbdma *dma) start(value byte) {
+	source := uint16(value) << 8
+	//sources above 0xDFFF read from the echo of WRAM
+	if source >= 0xE000 {
+		source -= 0x2000
+	}
+	gbdma.nextSource = source
+	gbdma.startDelay = 4
+}
+
+// advance the transfer by a number of CPU t-states
+func (gbdma *dma) step(cycles uint16) {
+	for ; cycles >= 4; cycles -= 4 {
+		starting := false
+		if gbdma.startDelay > 0 {
+			gbdma.startDelay -= 4
+			starting = gbdma.startDelay == 0
+		}
+
+		if gbdma.active {
+			gbmmu.memory[OAM_START+gbdma.index] = gbmmu.readByte(gbdma.source + gbdma.index)
+			gbdma.index++
+			if gbdma.index == DMA_LENGTH {
+				gbdma.active = false
+			}
+		}
+
+		if starting {
+			gbdma.active = true
+			gbdma.source = gbdma.nextSource
+			gbdma.index = 0
+		}
+	}
+}
+
+// true if the CPU cannot use an address because a transfer holds the bus.
+// Only the 0xFF00 page (I/O registers and HRAM) stays available, which is
+// why games run their DMA routine from HRAM
+func (gbdma *dma) blocks(address uint16) bool {
+	return gbdma.active && address < 0xFF00
+}
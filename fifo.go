@@ -0,0 +1,307 @@
+package main
+
+// renderers selectable with gbppu.renderer
+const (
+	RENDER_SCANLINE byte = iota //draw each line in one go at the end of mode 3
+	RENDER_FIFO                 //draw each line a dot at a time through the pixel FIFOs
+)
+
+// window position registers
+const WY uint16 = 0xFF4A
+const WX uint16 = 0xFF4B
+
+// dots taken by the first (discarded) tile fetch of each line, and by each sprite fetch
+const FIFO_START_DOTS = 6
+const SPRITE_FETCH_DOTS = 6
+
+type fifoPixel struct {
+	colour   byte
+	palette  byte   //background CGB palette number
+	priority bool   //background CGB BG-to-OAM priority attribute
+	window   bool   //background pixel from the window
+	flags    byte   //sprite attribute flags
+	oam      uint16 //sprite OAM address, for CGB OAM order priority
+}
+
+// The pixel FIFO renderer draws a line a dot at a time the way the hardware
+// does. A fetcher reads 8 background (or window) pixels at a time into the
+// background FIFO, and sprites are merged into the sprite FIFO when the
+// screen position reaches them. One pixel from each FIFO is mixed and shown
+// every dot. Registers are read as the line is drawn, so changes to SCX,
+// palettes or LCDC part way through a line show up where they happen, and
+// mode 3 lasts longer for fine scrolling, the window and sprites
+type pixelFifo struct {
+	bg  []fifoPixel
+	obj []fifoPixel
+	ly  byte
+	x   uint16 //next screen position to draw
+	//background fetcher - a step every 2 dots: tile number, low byte, high byte, then push
+	fetchStep  byte
+	fetchDots  byte
+	fetchX     byte //tile column of the next fetch
+	tile       byte
+	attributes byte
+	low, high  byte
+	startDots  byte //dots left of the discarded first fetch
+	discard    byte //pixels left to drop for SCX fine scrolling
+	//window
+	window     bool //fetching window tiles on this line
+	windowSeen bool //LY has matched WY this frame
+	windowLine byte //internal line counter, only advances on lines showing the window
+	//sprites
+	sprites     []uint16 //OAM addresses of the sprites on this line
+	fetched     [SPRITES_PER_LINE]bool
+	spriteFetch int //index into sprites being fetched, or -1
+	spriteDots  byte
+}
+
+var gbfifo pixelFifo
+
+// set up the FIFOs at the start of mode 3
+func (gbfifo *pixelFifo) startLine() {
+	gbfifo.ly = gbppu.read(gbppu.LY)
+	if gbfifo.ly == 0 {
+		gbfifo.windowSeen = false
+		gbfifo.windowLine = 0
+	} else if gbfifo.window {
+		gbfifo.windowLine++
+	}
+	if gbfifo.ly == gbppu.read(WY) {
+		gbfifo.windowSeen = true
+	}
+
+	gbfifo.bg = gbfifo.bg[:0]
+	gbfifo.obj = gbfifo.obj[:0]
+	gbfifo.x = 0
+	gbfifo.fetchStep = 0
+	gbfifo.fetchDots = 0
+	gbfifo.fetchX = 0
+	gbfifo.startDots = FIFO_START_DOTS
+	gbfifo.discard = gbppu.read(gbppu.SCX) % 8
+	gbfifo.window = false
+
+	gbfifo.sprites = gbppu.scanOAM(uint16(gbfifo.ly), spriteHeight(gbppu.read(gbppu.LCDC)))
+	gbfifo.fetched = [SPRITES_PER_LINE]bool{}
+	gbfifo.spriteFetch = -1
+}
+
+// run the FIFOs for one dot. Returns true when the line is complete
+func (gbfifo *pixelFifo) tick(gbscreen *frameBuffer) bool {
+	lcdc := gbppu.read(gbppu.LCDC)
+
+	if gbfifo.startDots > 0 {
+		gbfifo.startDots--
+		return false
+	}
+
+	//a sprite fetch stops pixels being pushed out until it completes
+	if gbfifo.spriteFetch >= 0 {
+		gbfifo.spriteDots++
+		if gbfifo.spriteDots == SPRITE_FETCH_DOTS {
+			gbfifo.fetchSprite(gbfifo.sprites[gbfifo.spriteFetch])
+			gbfifo.spriteFetch = -1
+		}
+		return false
+	}
+	if isBitSet(lcdc, 1) && gbfifo.discard == 0 {
+		for i, address := range gbfifo.sprites {
+			if !gbfifo.fetched[i] && uint16(gbppu.read(address+1)) <= gbfifo.x+8 {
+				gbfifo.fetched[i] = true
+				gbfifo.spriteFetch = i
+				gbfifo.spriteDots = 0
+				return false
+			}
+		}
+	}
+
+	//reaching the window restarts the fetcher on window tiles
+	if !gbfifo.window && isBitSet(lcdc, 5) && gbfifo.windowSeen && gbfifo.x+7 >= uint16(gbppu.read(WX)) {
+		gbfifo.window = true
+		gbfifo.bg = gbfifo.bg[:0]
+		gbfifo.fetchStep = 0
+		gbfifo.fetchDots = 0
+		gbfifo.fetchX = 0
+	}
+
+	gbfifo.stepFetcher(lcdc)
+
+	if len(gbfifo.bg) == 0 {
+		return false
+	}
+	bg := gbfifo.bg[0]
+	gbfifo.bg = gbfifo.bg[1:]
+	if gbfifo.discard > 0 {
+		gbfifo.discard--
+		return false
+	}
+	var obj fifoPixel
+	if len(gbfifo.obj) > 0 {
+		obj = gbfifo.obj[0]
+		gbfifo.obj = gbfifo.obj[1:]
+	}
+	gbfifo.mix(gbscreen, lcdc, bg, obj)
+
+	gbfifo.x++
+	return gbfifo.x == SCRWIDTH
+}
+
+// run the background fetcher for one dot
+func (gbfifo *pixelFifo) stepFetcher(lcdc byte) {
+	if gbfifo.fetchStep == 3 {
+		//push once the FIFO is empty
+		if len(gbfifo.bg) > 0 {
+			return
+		}
+		for j := uint16(0); j < 8; j++ {
+			x := j
+			if isBitSet(gbfifo.attributes, 5) {
+				x = 7 - j
+			}
+			gbfifo.bg = append(gbfifo.bg, fifoPixel{
+				colour:   tileColour(gbfifo.low, gbfifo.high, x),
+				palette:  gbfifo.attributes & 7,
+				priority: isBitSet(gbfifo.attributes, 7),
+				window:   gbfifo.window,
+			})
+		}
+		gbfifo.fetchX++
+		gbfifo.fetchStep = 0
+		return
+	}
+
+	gbfifo.fetchDots++
+	if gbfifo.fetchDots < 2 {
+		return
+	}
+	gbfifo.fetchDots = 0
+
+	//work out the tile map entry and the row within the tile
+	var mapAddress uint16
+	var y byte
+	if gbfifo.window {
+		mapAddress = tileMapBase(lcdc, 6) + uint16(gbfifo.windowLine/8)*32 + uint16(gbfifo.fetchX&31)
+		y = gbfifo.windowLine
+	} else {
+		y = gbfifo.ly + gbppu.read(gbppu.SCY)
+		column := (gbppu.read(gbppu.SCX)/8 + gbfifo.fetchX) & 31
+		mapAddress = tileMapBase(lcdc, 3) + uint16(y/8)*32 + uint16(column)
+	}
+	row := uint16(y % 8)
+	if isBitSet(gbfifo.attributes, 6) {
+		row = 7 - row
+	}
+	bank := gbfifo.attributes >> 3 & 1
+
+	switch gbfifo.fetchStep {
+	case 0:
+		gbfifo.tile = gbppu.vramByte(0, mapAddress)
+		gbfifo.attributes = gbppu.bgAttributes(mapAddress)
+	case 1:
+		gbfifo.low = gbppu.vramByte(bank, tileDataAddress(lcdc, gbfifo.tile, row))
+	case 2:
+		gbfifo.high = gbppu.vramByte(bank, tileDataAddress(lcdc, gbfifo.tile, row)+1)
+	}
+	gbfifo.fetchStep++
+}
+
+// fetch a sprite's pixels for this line and merge them into the sprite FIFO.
+// Sprite pixels only replace transparent ones, so the sprite fetched first
+// (the lowest X) wins on the DMG. The CGB uses OAM order instead
+func (gbfifo *pixelFifo) fetchSprite(address uint16) {
+	lcdc := gbppu.read(gbppu.LCDC)
+	height := spriteHeight(lcdc)
+	y := uint16(gbppu.read(address))
+	x := uint16(gbppu.read(address + 1))
+	tile := uint16(gbppu.read(address + 2))
+	flags := gbppu.read(address + 3)
+
+	row := uint16(gbfifo.ly) + 16 - y
+	if isBitSet(flags, 6) {
+		row = height - 1 - row
+	}
+	if height == 16 {
+		tile &= 0xFE
+	}
+	var bank byte
+	if gbcgb.active() {
+		bank = flags >> 3 & 1
+	}
+	tileRowAddress := 0x8000 + tile*16 + row*2
+	low := gbppu.vramByte(bank, tileRowAddress)
+	high := gbppu.vramByte(bank, tileRowAddress+1)
+
+	//pixels of a sprite partly off the left of the screen are skipped
+	skip := gbfifo.x + 8 - x
+	oamOrder := gbcgb.enabled && gbcgb.opri == 0
+	for j := skip; j < 8; j++ {
+		pixelX := j
+		if isBitSet(flags, 5) {
+			pixelX = 7 - j
+		}
+		pixel := fifoPixel{colour: tileColour(low, high, pixelX), flags: flags, oam: address}
+		slot := int(j - skip)
+		switch {
+		case slot >= len(gbfifo.obj):
+			gbfifo.obj = append(gbfifo.obj, pixel)
+		case gbfifo.obj[slot].colour == 0:
+			gbfifo.obj[slot] = pixel
+		case oamOrder && pixel.colour != 0 && address < gbfifo.obj[slot].oam:
+			gbfifo.obj[slot] = pixel
+		}
+	}
+}
+
+// mix a background and sprite pixel and draw it
+func (gbfifo *pixelFifo) mix(gbscreen *frameBuffer, lcdc byte, bg fifoPixel, obj fifoPixel) {
+	colour := bg.colour
+	//on the DMG, clearing LCDC bit 0 blanks the background and window
+	if !gbcgb.active() && !isBitSet(lcdc, 0) {
+		colour = 0
+	}
+	layer := LAYER_BG
+	if bg.window {
+		layer = LAYER_WINDOW
+	}
+	if !gblayers.shown(layer) {
+		colour = 0
+	}
+	pixelIndex := screenIndex(gbfifo.x, uint16(gbfifo.ly))
+	bgColour[pixelIndex] = colour
+	bgPriority[pixelIndex] = bg.priority
+	rgb := gblayers.tint(layer, gbppu.bgRGB(pixelIndex, bg.palette, colour))
+
+	if obj.colour != 0 && isBitSet(lcdc, 1) && gblayers.shown(LAYER_OBJ) {
+		bgMasterPriority := !gbcgb.active() || isBitSet(lcdc, 0)
+		if !(bgMasterPriority && (isBitSet(obj.flags, 7) || bg.priority) && colour != 0) {
+			rgb = gblayers.tint(LAYER_OBJ, gbppu.objRGB(pixelIndex, obj.flags, obj.colour))
+		}
+	}
+	gbscreen[pixelIndex] = rgb
+}
+
+// get the tile map selected by an LCDC bit (3 for the background, 6 for the window)
+func tileMapBase(lcdc byte, bit int) uint16 {
+	if isBitSet(lcdc, bit) {
+		return 0x9C00
+	}
+	return 0x9800
+}
+
+// get the address of a tile row in the background and window tile data
+// selected by LCDC bit 4 - 0x8000 with unsigned tile numbers when set,
+// otherwise 0x9000 with signed tile numbers
+func tileDataAddress(lcdc byte, tile byte, row uint16) uint16 {
+	if isBitSet(lcdc, 4) {
+		return 0x8000 + uint16(tile)*16 + row*2
+	}
+	return uint16(0x9000+int(int8(tile))*16) + row*2
+}
+
+// switch between the scanline and pixel FIFO renderers
+func (gbppu *ppu) toggleRenderer() {
+	if gbppu.renderer == RENDER_FIFO {
+		gbppu.renderer = RENDER_SCANLINE
+	} else {
+		gbppu.renderer = RENDER_FIFO
+	}
+}
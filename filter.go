@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Scaling filters enlarge the frame on the CPU before it is shown. Each is a
+// pure function of the source image and a whole number scale factor, so
+// they can be used on saved frames as well as in the window
+
+type scaleFilter func(src *image.RGBA, scale int) *image.RGBA
+
+var scaleFilters = map[string]scaleFilter{
+	"nearest": scaleNearest,
+	"scale2x": scale2xFilter,
+	"scale3x": scale3xFilter,
+	"epx":     epxFilter,
+	"xbr":     xbrFilter,
+	"lcd":     lcdFilter,
+}
+
+// order the filters are cycled through with the hotkey
+var filterNames = []string{"nearest", "scale2x", "scale3x", "epx", "xbr", "lcd"}
+
+const DEFAULT_SCALE = 3
+
+// the filter and scale used for the window
+var currentFilter = "nearest"
+var displayScale = DEFAULT_SCALE
+
+// select a filter by name
+func selectFilter(name string) error {
+	if _, ok := scaleFilters[name]; !ok {
+		return fmt.Errorf("unknown filter %q", name)
+	}
+	currentFilter = name
+	return nil
+}
+
+// move on to the next filter
+func nextFilter() {
+	for i, name := range filterNames {
+		if name == currentFilter {
+			currentFilter = filterNames[(i+1)%len(filterNames)]
+			break
+		}
+	}
+	fmt.Printf("Filter: %s\n", currentFilter)
+}
+
+// scale a frame for display with the current filter
+func applyFilter(src *image.RGBA) *image.RGBA {
+	return scaleFilters[currentFilter](src, displayScale)
+}
+
+// get a pixel, repeating the edge pixels for coordinates outside the image
+func pixelAt(src *image.RGBA, x, y int) color.RGBA {
+	bounds := src.Bounds()
+	if x < bounds.Min.X {
+		x = bounds.Min.X
+	} else if x >= bounds.Max.X {
+		x = bounds.Max.X - 1
+	}
+	if y < bounds.Min.Y {
+		y = bounds.Min.Y
+	} else if y >= bounds.Max.Y {
+		y = bounds.Max.Y - 1
+	}
+	pix := src.Pix[src.PixOffset(x, y):]
+	return color.RGBA{pix[0], pix[1], pix[2], pix[3]}
+}
+
+func setPixel(dst *image.RGBA, x, y int, c color.RGBA) {
+	pix := dst.Pix[dst.PixOffset(x, y):]
+	pix[0], pix[1], pix[2], pix[3] = c.R, c.G, c.B, c.A
+}
+
+// a fixed size filter, e.g. Scale2x doubles the image
+type filterStep struct {
+	factor int
+	apply  func(*image.RGBA) *image.RGBA
+}
+
+// build any scale from fixed size filters: apply each step, in order, as
+// many times as it divides the scale, so 4x is Scale2x twice and 3x uses
+// Scale3x even for Scale2x. Only factors no step can make (5x, 7x) are
+// left to nearest neighbour
+func chainFilter(src *image.RGBA, scale int, steps ...filterStep) *image.RGBA {
+	for _, step := range steps {
+		for scale >= step.factor && scale%step.factor == 0 {
+			src = step.apply(src)
+			scale /= step.factor
+		}
+	}
+	return scaleNearest(src, scale)
+}
+
+// Scale2x (AdvMAME2x). Each pixel E becomes four, taking the colour of a
+// neighbour where two neighbours meet at that corner and no edge crosses it:
+//
+//	  B           E0 E1
+//	D E F   ->    E2 E3
+//	  H
+func scale2xFilter(src *image.RGBA, scale int) *image.RGBA {
+	return chainFilter(src, scale, filterStep{2, scale2x}, filterStep{3, scale3x})
+}
+
+func scale2x(src *image.RGBA) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*2, bounds.Dy()*2))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			sx, sy := bounds.Min.X+x, bounds.Min.Y+y
+			b, d, e := pixelAt(src, sx, sy-1), pixelAt(src, sx-1, sy), pixelAt(src, sx, sy)
+			f, h := pixelAt(src, sx+1, sy), pixelAt(src, sx, sy+1)
+			e0, e1, e2, e3 := e, e, e, e
+			if b != h && d != f {
+				if d == b {
+					e0 = d
+				}
+				if b == f {
+					e1 = f
+				}
+				if d == h {
+					e2 = d
+				}
+				if h == f {
+					e3 = f
+				}
+			}
+			setPixel(dst, x*2, y*2, e0)
+			setPixel(dst, x*2+1, y*2, e1)
+			setPixel(dst, x*2, y*2+1, e2)
+			setPixel(dst, x*2+1, y*2+1, e3)
+		}
+	}
+	return dst
+}
+
+// Scale3x (AdvMAME3x), the same idea as Scale2x over a 3x3 block. Scales
+// it can't make use Scale2x steps:
+//
+//	A B C         E0 E1 E2
+//	D E F   ->    E3 E4 E5
+//	G H I         E6 E7 E8
+func scale3xFilter(src *image.RGBA, scale int) *image.RGBA {
+	return chainFilter(src, scale, filterStep{3, scale3x}, filterStep{2, scale2x})
+}
+
+func scale3x(src *image.RGBA) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*3, bounds.Dy()*3))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			sx, sy := bounds.Min.X+x, bounds.Min.Y+y
+			a, b, c := pixelAt(src, sx-1, sy-1), pixelAt(src, sx, sy-1), pixelAt(src, sx+1, sy-1)
+			d, e, f := pixelAt(src, sx-1, sy), pixelAt(src, sx, sy), pixelAt(src, sx+1, sy)
+			g, h, i := pixelAt(src, sx-1, sy+1), pixelAt(src, sx, sy+1), pixelAt(src, sx+1, sy+1)
+			out := [9]color.RGBA{e, e, e, e, e, e, e, e, e}
+			if b != h && d != f {
+				if d == b {
+					out[0] = d
+				}
+				if (d == b && e != c) || (b == f && e != a) {
+					out[1] = b
+				}
+				if b == f {
+					out[2] = f
+				}
+				if (d == b && e != g) || (d == h && e != a) {
+					out[3] = d
+				}
+				if (b == f && e != i) || (h == f && e != c) {
+					out[5] = f
+				}
+				if d == h {
+					out[6] = d
+				}
+				if (d == h && e != i) || (h == f && e != g) {
+					out[7] = h
+				}
+				if h == f {
+					out[8] = f
+				}
+			}
+			for n, colour := range out {
+				setPixel(dst, x*3+n%3, y*3+n/3, colour)
+			}
+		}
+	}
+	return dst
+}
+
+// EPX, Eric Johnston's original 2x filter. Like Scale2x, but a corner only
+// takes a neighbour's colour when at most two of the four neighbours match,
+// which leaves solid areas and single pixel lines alone. Odd scales use
+// Scale3x, which grew out of EPX
+func epxFilter(src *image.RGBA, scale int) *image.RGBA {
+	return chainFilter(src, scale, filterStep{2, epx}, filterStep{3, scale3x})
+}
+
+func epx(src *image.RGBA) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*2, bounds.Dy()*2))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			sx, sy := bounds.Min.X+x, bounds.Min.Y+y
+			a, c, p := pixelAt(src, sx, sy-1), pixelAt(src, sx-1, sy), pixelAt(src, sx, sy)
+			b, d := pixelAt(src, sx+1, sy), pixelAt(src, sx, sy+1)
+			p1, p2, p3, p4 := p, p, p, p
+			//three or four matching neighbours means no edge to smooth
+			if !(a == b && a == c) && !(a == b && a == d) && !(a == c && a == d) && !(b == c && b == d) {
+				if c == a {
+					p1 = a
+				}
+				if a == b {
+					p2 = b
+				}
+				if d == c {
+					p3 = c
+				}
+				if b == d {
+					p4 = d
+				}
+			}
+			setPixel(dst, x*2, y*2, p1)
+			setPixel(dst, x*2+1, y*2, p2)
+			setPixel(dst, x*2, y*2+1, p3)
+			setPixel(dst, x*2+1, y*2+1, p4)
+		}
+	}
+	return dst
+}
+
+// An xBR style filter. For each corner of a pixel it weighs the colour
+// differences along the two diagonals over a 4x4 neighbourhood; where the
+// edge runs across the corner, the corner of the scaled pixel is blended
+// towards the nearer neighbour, more strongly the further into the corner.
+// Named as for the bottom right corner, with E the pixel being scaled:
+//
+//	   A1 B1 C1
+//	A0 A  B  C  C4
+//	D0 D  E  F  F4
+//	G0 G  H  I  I4
+//	   G5 H5 I5
+func xbrFilter(src *image.RGBA, scale int) *image.RGBA {
+	if scale < 2 {
+		return src
+	}
+	bounds := src.Bounds()
+	dst := scaleNearest(src, scale)
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			//each corner in turn, rotating the neighbourhood a quarter turn each time
+			for rotation := 0; rotation < 4; rotation++ {
+				at := func(dx, dy int) color.RGBA {
+					for r := 0; r < rotation; r++ {
+						dx, dy = -dy, dx
+					}
+					return pixelAt(src, bounds.Min.X+x+dx, bounds.Min.Y+y+dy)
+				}
+				e, f, h, i := at(0, 0), at(1, 0), at(0, 1), at(1, 1)
+				if e == f || e == h {
+					continue
+				}
+				b, c, d, g := at(0, -1), at(1, -1), at(-1, 0), at(-1, 1)
+				f4, i4, h5, i5 := at(2, 0), at(2, 1), at(0, 2), at(1, 2)
+				across := colourDistance(e, c) + colourDistance(e, g) + colourDistance(i, f4) + colourDistance(i, h5) + 4*colourDistance(h, f)
+				along := colourDistance(h, d) + colourDistance(h, i5) + colourDistance(f, i4) + colourDistance(f, b) + 4*colourDistance(e, i)
+				if across >= along {
+					continue
+				}
+				blend := h
+				if colourDistance(e, f) <= colourDistance(e, h) {
+					blend = f
+				}
+				xbrCorner(dst, x, y, scale, rotation, blend)
+			}
+		}
+	}
+	return dst
+}
+
+// blend one corner of a scaled pixel towards a colour. Sub-pixels are
+// measured from the centre, so at 2x only the corner sub-pixel changes and
+// at higher scales the blend fades out towards the opposite corner
+func xbrCorner(dst *image.RGBA, x, y, scale, rotation int, blend color.RGBA) {
+	for j := 0; j < scale; j++ {
+		for i := 0; i < scale; i++ {
+			//centre relative position, turned back to the bottom right corner
+			cx, cy := 2*i+1-scale, 2*j+1-scale
+			for r := 0; r < rotation; r++ {
+				cx, cy = cy, -cx
+			}
+			amount := cx + cy
+			if amount <= 0 {
+				continue
+			}
+			px, py := x*scale+i, y*scale+j
+			setPixel(dst, px, py, mixColour(pixelAt(dst, px, py), blend, amount, 2*(scale-1)))
+		}
+	}
+}
+
+// mix n/d of colour b into colour a
+func mixColour(a, b color.RGBA, n, d int) color.RGBA {
+	if n > d {
+		n = d
+	}
+	mix := func(x, y uint8) uint8 {
+		return uint8((int(x)*(d-n) + int(y)*n) / d)
+	}
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), mix(a.A, b.A)}
+}
+
+// how different two colours look, weighting brightness over hue as xBR does
+func colourDistance(a, b color.RGBA) int {
+	abs := func(n int) int {
+		if n < 0 {
+			return -n
+		}
+		return n
+	}
+	r, g, bl := int(a.R)-int(b.R), int(a.G)-int(b.G), int(a.B)-int(b.B)
+	y := (299*r + 587*g + 114*bl) / 1000
+	u := (-169*r - 331*g + 500*bl) / 1000
+	v := (500*r - 419*g - 81*bl) / 1000
+	return 48*abs(y) + 7*abs(u) + 6*abs(v)
+}
+
+// LCD grid: nearest neighbour with the right and bottom edge of each
+// scaled pixel darkened, like the gaps between the dots of the real screen.
+// Below 3x the gaps would swamp the picture, so they are only lightly shaded
+func lcdFilter(src *image.RGBA, scale int) *image.RGBA {
+	if scale < 2 {
+		return src
+	}
+	dst := scaleNearest(src, scale)
+	//keep 3/4 of the brightness in the gaps, or 7/8 at 2x
+	keep, out := 3, 4
+	if scale == 2 {
+		keep, out = 7, 8
+	}
+	bounds := dst.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			if x%scale != scale-1 && y%scale != scale-1 {
+				continue
+			}
+			pix := dst.Pix[dst.PixOffset(x, y):]
+			for n := 0; n < 3; n++ {
+				pix[n] = uint8(int(pix[n]) * keep / out)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+var testPalette = map[byte]color.RGBA{
+	'K': {0, 0, 0, 255},
+	'W': {255, 255, 255, 255},
+	'g': {191, 191, 191, 255}, //white in an LCD gap at 3x
+}
+
+// build an image from rows of palette letters
+func testImage(rows ...string) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, len(rows[0]), len(rows)))
+	for y, row := range rows {
+		for x := range row {
+			img.SetRGBA(x, y, testPalette[row[x]])
+		}
+	}
+	return img
+}
+
+// describe an image as rows of palette letters, '?' for other colours
+func imageRows(img *image.RGBA) string {
+	var rows []string
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		var row strings.Builder
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			letter := byte('?')
+			for l, colour := range testPalette {
+				if img.RGBAAt(x, y) == colour {
+					letter = l
+				}
+			}
+			row.WriteByte(letter)
+		}
+		rows = append(rows, row.String())
+	}
+	return strings.Join(rows, "\n")
+}
+
+func TestFilters(t *testing.T) {
+	//a corner, which the pixel art filters round off
+	corner := testImage(
+		"KW",
+		"WW",
+	)
+	scale2xCorner := []string{
+		"KKWW",
+		"KWWW",
+		"WWWW",
+		"WWWW",
+	}
+	scale3xCorner := []string{
+		"KKKWWW",
+		"KKWWWW",
+		"KWWWWW",
+		"WWWWWW",
+		"WWWWWW",
+		"WWWWWW",
+	}
+	tests := []struct {
+		filter string
+		src    *image.RGBA
+		scale  int
+		want   []string
+	}{
+		{"nearest", corner, 2, []string{"KKWW", "KKWW", "WWWW", "WWWW"}},
+		{"scale2x", corner, 1, []string{"KW", "WW"}},
+		{"scale2x", corner, 2, scale2xCorner},
+		{"scale2x", corner, 3, scale3xCorner},
+		{"scale2x", corner, 4, []string{
+			"KKKKWWWW",
+			"KKKWWWWW",
+			"KKKWWWWW",
+			"KWWWWWWW",
+			"WWWWWWWW",
+			"WWWWWWWW",
+			"WWWWWWWW",
+			"WWWWWWWW",
+		}},
+		{"scale3x", corner, 3, scale3xCorner},
+		{"scale3x", corner, 2, scale2xCorner},
+		{"epx", corner, 2, scale2xCorner},
+		{"epx", corner, 3, scale3xCorner},
+		{"lcd", testImage("W"), 3, []string{"WWg", "WWg", "ggg"}},
+		//nothing to smooth in a single colour
+		{"xbr", testImage("WW", "WW"), 3, []string{"WWWWWW", "WWWWWW", "WWWWWW", "WWWWWW", "WWWWWW", "WWWWWW"}},
+		{"epx", testImage("KK", "KK"), 4, []string{"KKKKKKKK", "KKKKKKKK", "KKKKKKKK", "KKKKKKKK", "KKKKKKKK", "KKKKKKKK", "KKKKKKKK", "KKKKKKKK"}},
+	}
+	for _, test := range tests {
+		got := imageRows(scaleFilters[test.filter](test.src, test.scale))
+		want := strings.Join(test.want, "\n")
+		if got != want {
+			t.Errorf("%s at %dx:\n%s\nwant:\n%s", test.filter, test.scale, got, want)
+		}
+	}
+}
+
+func TestFilterSizes(t *testing.T) {
+	src := testImage("KW", "WK", "KK")
+	for _, name := range filterNames {
+		for scale := 1; scale <= 6; scale++ {
+			bounds := scaleFilters[name](src, scale).Bounds()
+			if bounds.Dx() != 2*scale || bounds.Dy() != 3*scale {
+				t.Errorf("%s at %dx gave %dx%d", name, scale, bounds.Dx(), bounds.Dy())
+			}
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GBS files are music ripped from games: the game's sound driver code with
+// a header saying where to load it and which routines to call. The player
+// loads the code, calls init with the track number in A, then calls play
+// at the rate the header asks for - every VBlank, or every timer overflow
+// when TAC enables the timer. The CPU does not dispatch interrupts yet, so
+// the routines are called directly, with a return address the player
+// watches for. Between calls the CPU idles while the APU keeps running.
+//
+// The code is laid out as a cartridge ROM, starting at the load address,
+// with bank 0 fixed at 0x0000-0x3FFF and the bank selected by writing to
+// 0x2000-0x3FFF mapped at 0x4000-0x7FFF, the way MBC1-style drivers expect
+const GBS_HEADER_SIZE = 0x70
+
+// where routines return to - never executed, the player takes over when PC reaches it
+const GBS_RETURN uint16 = 0x00F0
+
+const GBS_BANK_SIZE = 0x4000
+
+// header offsets
+const (
+	GBS_VERSION    = 0x03
+	GBS_SONGS      = 0x04
+	GBS_FIRST_SONG = 0x05
+	GBS_LOAD       = 0x06
+	GBS_INIT       = 0x08
+	GBS_PLAY       = 0x0A
+	GBS_STACK      = 0x0C
+	GBS_TMA        = 0x0E
+	GBS_TAC        = 0x0F
+	GBS_TITLE      = 0x10
+	GBS_AUTHOR     = 0x30
+	GBS_COPYRIGHT  = 0x50
+)
+
+type gbsHeader struct {
+	songs     byte
+	firstSong byte //1 based, as stored
+	load      uint16
+	init      uint16
+	play      uint16
+	stack     uint16
+	tma, tac  byte
+	title     string
+	author    string
+	copyright string
+}
+
+type gbsPlayer struct {
+	enabled  bool
+	header   gbsHeader
+	rom      []byte //the code at its load address, padded to whole banks
+	bank     int    //mapped at 0x4000-0x7FFF
+	track    int    //0 based
+	skip     int    //tracks to move by, from the hotkeys
+	nextPlay uint64 //totalCycles when play is next due
+}
+
+var gbgbs gbsPlayer
+
+// check whether a file should be played as GBS music rather than run as a ROM
+func isGBSFile(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".gbs")
+}
+
+// read a GBS header
+func parseGBSHeader(data []byte) (gbsHeader, error) {
+	var header gbsHeader
+	if len(data) < GBS_HEADER_SIZE || string(data[:3]) != "GBS" {
+		return header, errors.New("not a GBS file")
+	}
+	if data[GBS_VERSION] != 1 {
+		return header, fmt.Errorf("unsupported GBS version %d", data[GBS_VERSION])
+	}
+	word := func(offset int) uint16 {
+		return binary.LittleEndian.Uint16(data[offset:])
+	}
+	text := func(offset int) string {
+		field := data[offset : offset+32]
+		if end := bytes.IndexByte(field, 0); end >= 0 {
+			field = field[:end]
+		}
+		return strings.TrimSpace(string(field))
+	}
+	header = gbsHeader{
+		songs:     data[GBS_SONGS],
+		firstSong: data[GBS_FIRST_SONG],
+		load:      word(GBS_LOAD),
+		init:      word(GBS_INIT),
+		play:      word(GBS_PLAY),
+		stack:     word(GBS_STACK),
+		tma:       data[GBS_TMA],
+		tac:       data[GBS_TAC],
+		title:     text(GBS_TITLE),
+		author:    text(GBS_AUTHOR),
+		copyright: text(GBS_COPYRIGHT),
+	}
+	if header.songs == 0 {
+		return header, errors.New("GBS file has no songs")
+	}
+	if header.load < 0x0400 || header.load >= rom_end {
+		return header, fmt.Errorf("GBS load address %04X is outside ROM", header.load)
+	}
+	return header, nil
+}
+
+// load a GBS file, ready for startTrack
+func (gbgbs *gbsPlayer) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	header, err := parseGBSHeader(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	gbgbs.header = header
+
+	//RST vectors jump to the same offset from the load address
+	code := data[GBS_HEADER_SIZE:]
+	size := int(header.load) + len(code)
+	size = (size + GBS_BANK_SIZE - 1) / GBS_BANK_SIZE * GBS_BANK_SIZE
+	if size < 2*GBS_BANK_SIZE {
+		size = 2 * GBS_BANK_SIZE
+	}
+	gbgbs.rom = make([]byte, size)
+	copy(gbgbs.rom[header.load:], code)
+	for vector := uint16(0); vector < 0x40; vector += 8 {
+		target := header.load + vector
+		gbgbs.rom[vector] = 0xC3 //JP a16
+		gbgbs.rom[vector+1] = getlsb(target)
+		gbgbs.rom[vector+2] = getmsb(target)
+	}
+	//name screenshots and recordings after the music
+	copy(gbrom.title[:], header.title)
+	gbgbs.enabled = true
+	return nil
+}
+
+// reset the machine and start playing a track (0 based) by calling init
+func (gbgbs *gbsPlayer) startTrack(gbcpu *cpu, track int) {
+	songs := int(gbgbs.header.songs)
+	gbgbs.track = (track%songs + songs) % songs
+
+	//fresh memory, the code is read from the ROM banks
+	gbmmu.memory = [mem_size]byte{}
+	gbmmu.wram = [8][0x1000]byte{}
+	gbgbs.bank = 1
+	//boot ROM is unmapped, the LCD is on (blank) so frames keep coming
+	gbmmu.memory[0xFF50] = 1
+	gbmmu.memory[gbppu.LCDC] = 0x80
+	gbmmu.memory[TMA] = gbgbs.header.tma
+	gbmmu.memory[TAC] = gbgbs.header.tac
+	gbspeed.double = gbcgb.enabled && isBitSet(gbgbs.header.tac, 7)
+
+	//sound on, as the boot ROM leaves it
+	gbapu.initialise()
+	gbmmu.storeByte(NR52, 0x80)
+	gbmmu.storeByte(NR50, 0x77)
+	gbmmu.storeByte(NR51, 0xF3)
+
+	gbcpu.sp = gbgbs.header.stack
+	gbcpu.a = byte(gbgbs.track)
+	gbgbs.call(gbcpu, gbgbs.header.init)
+	gbgbs.nextPlay = totalCycles + gbgbs.playPeriod()
+	fmt.Printf("Playing track %d of %d\n", gbgbs.track+1, songs)
+}
+
+// read the ROM area, with the selected bank at 0x4000-0x7FFF
+func (gbgbs *gbsPlayer) readROM(address uint16) byte {
+	offset := int(address)
+	if address >= GBS_BANK_SIZE {
+		offset += (gbgbs.bank - 1) * GBS_BANK_SIZE
+	}
+	if offset >= len(gbgbs.rom) {
+		return 0xFF
+	}
+	return gbgbs.rom[offset]
+}
+
+// handle a write to the ROM area - only bank selects do anything
+func (gbgbs *gbsPlayer) writeROM(address uint16, value byte) {
+	if address >= 0x2000 && address < 0x4000 {
+		//bank 0 cannot be selected for 0x4000-0x7FFF
+		gbgbs.bank = int(value)
+		if gbgbs.bank == 0 {
+			gbgbs.bank = 1
+		}
+	}
+}
+
+// push the return address the way CALL does and jump to a routine
+func (gbgbs *gbsPlayer) call(gbcpu *cpu, address uint16) {
+	gbmmu.storeByte(gbcpu.sp, getlsb(GBS_RETURN))
+	gbcpu.sp--
+	gbmmu.storeByte(gbcpu.sp, getmsb(GBS_RETURN))
+	gbcpu.sp--
+	gbcpu.pc = address
+}
+
+// get the t-states between play calls - a timer overflow when TAC enables
+// the timer, otherwise a frame
+func (gbgbs *gbsPlayer) playPeriod() uint64 {
+	tac := gbmmu.memory[TAC]
+	if isBitSet(tac, 2) {
+		return (256 - uint64(gbmmu.memory[TMA])) * TIMER_DIVIDERS[tac&3]
+	}
+	if gbspeed.double {
+		return DOTS_PER_FRAME * 2
+	}
+	return DOTS_PER_FRAME
+}
+
+// run the player for one instruction, or a moment of idling between calls
+func (gbgbs *gbsPlayer) step(gbcpu *cpu) {
+	if gbgbs.skip != 0 {
+		gbgbs.startTrack(gbcpu, gbgbs.track+gbgbs.skip)
+		gbgbs.skip = 0
+	}
+	if gbcpu.pc != GBS_RETURN {
+		gbcpu.execute()
+		return
+	}
+	if totalCycles < gbgbs.nextPlay {
+		tstates += 4
+		clockPeripherals()
+		return
+	}
+	//a play routine that overruns delays the next call rather than being re-entered
+	gbgbs.nextPlay = totalCycles + gbgbs.playPeriod()
+	gbgbs.call(gbcpu, gbgbs.header.play)
+}
+
+// change track before the next instruction, wrapping round at either end
+func (gbgbs *gbsPlayer) skipTrack(offset int) {
+	gbgbs.skip += offset
+}
+
+// get the track to start on from the -track flag or the header
+func (gbgbs *gbsPlayer) firstTrack() int {
+	if gbsTrack > 0 {
+		return gbsTrack - 1
+	}
+	if gbgbs.header.firstSong > 0 {
+		return int(gbgbs.header.firstSong) - 1
+	}
+	return 0
+}
+
+// show what is playing on the (otherwise blank) screen
+func (gbgbs *gbsPlayer) drawInfo(frame *image.RGBA) {
+	lines := []string{
+		gbgbs.header.title,
+		gbgbs.header.author,
+		gbgbs.header.copyright,
+		"",
+		fmt.Sprintf("Track %d/%d", gbgbs.track+1, gbgbs.header.songs),
+		"",
+		"Left/Right: track",
+	}
+	offset := frame.Rect.Min
+	if gbsgb.enabled {
+		offset = image.Pt(SGB_SCREEN_X, SGB_SCREEN_Y)
+	}
+	for i, line := range lines {
+		drawText(frame, offset.X+4, offset.Y+4+i*DEBUG_LINE_HEIGHT, line, shadeColour(3))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+// CGB VRAM DMA registers. HDMA1-4 hold the source and destination,
+// writing HDMA5 starts a transfer of (bits 0-6 + 1) * 16 bytes.
+// Bit 7 of HDMA5 selects the mode:
+// 0 - general purpose DMA, copies everything at once while the CPU is halted
+// 1 - HBlank DMA, copies 16 bytes at the start of each HBlank
+const (
+	HDMA1 uint16 = 0xFF51
+	HDMA2 uint16 = 0xFF52
+	HDMA3 uint16 = 0xFF53
+	HDMA4 uint16 = 0xFF54
+	HDMA5 uint16 = 0xFF55
+)
+
+const HDMA_BLOCK uint16 = 0x10
+
+// each 16 byte block takes 8 microseconds (32 dots) in either speed
+const HDMA_BLOCK_DOTS uint16 = 32
+
+type hdma struct {
+	source      uint16
+	destination uint16
+	active      bool //HBlank transfer in progress
+	remaining   byte //blocks left minus one, as read from HDMA5
+}
+
+var gbhdma hdma
+
+func (gbhdma *hdma) read(address uint16) byte {
+	if address != HDMA5 {
+		//HDMA1-4 are write only
+		return 0xFF
+	}
+	if gbhdma.active {
+		return gbhdma.remaining
+	}
+	return 0x80 | gbhdma.remaining
+}
+
+func (gbhdma *hdma) write(address uint16, value byte) {
+	switch address {
+	case HDMA1:
+		gbhdma.source = makeWord(value, getlsb(gbhdma.source))
+	case HDMA2:
+		gbhdma.source = makeWord(getmsb(gbhdma.source), value&0xF0)
+	case HDMA3:
+		//destination is always in VRAM
+		gbhdma.destination = makeWord(value&0x1F|0x80, getlsb(gbhdma.destination))
+	case HDMA4:
+		gbhdma.destination = makeWord(getmsb(gbhdma.destination), value&0xF0)
+	case HDMA5:
+		gbhdma.start(value)
+	}
+}
+
+func (gbhdma *hdma) start(value byte) {
+	//writing with bit 7 clear during an HBlank transfer cancels it
+	if gbhdma.active && !isBitSet(value, 7) {
+		gbhdma.active = false
+		return
+	}
+
+	gbhdma.remaining = value & 0x7F
+	if !isBitSet(value, 7) {
+		//general purpose DMA
+		for gbhdma.copyBlock() {
+		}
+		return
+	}
+
+	gbhdma.active = true
+	//starting during HBlank copies the first block straight away
+	if gbppu.mode == MODE_HBLANK && isBitSet(gbppu.read(gbppu.LCDC), 7) {
+		gbhdma.hblank()
+	}
+}
+
+// called by the PPU at the start of HBlank on each visible line
+func (gbhdma *hdma) hblank() {
+	if gbhdma.active {
+		gbhdma.active = gbhdma.copyBlock()
+	}
+}
+
+// copy one block of 16 bytes, halting the CPU while it happens.
+// Returns false once the last block has been copied
+func (gbhdma *hdma) copyBlock() bool {
+	for i := uint16(0); i < HDMA_BLOCK; i++ {
+		value := gbmmu.readByte(gbhdma.source + i)
+		gbmmu.vram[gbmmu.vramBank][(gbhdma.destination+i)&0x1FFF] = value
+	}
+	gbhdma.source += HDMA_BLOCK
+	gbhdma.destination += HDMA_BLOCK
+	//the CPU is halted while the block is copied
+	tstates += HDMA_BLOCK_DOTS
+	if gbspeed.double {
+		tstates += HDMA_BLOCK_DOTS
+	}
+
+	gbhdma.remaining--
+	//the remaining count wraps to 0x7F (HDMA5 reads 0xFF) when complete
+	if gbhdma.remaining == 0xFF {
+		gbhdma.remaining = 0x7F
+		return false
+	}
+	return true
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// exit statuses for headless runs
+const (
+	EXIT_CONDITION_MET = 0 //a stop condition was reached, or the limit when there are none
+	EXIT_LIMIT_REACHED = 1 //the frame or cycle limit was reached before a stop condition
+	EXIT_BAD_OPTIONS   = 2
+	EXIT_LOAD_FAILED   = 3 //the ROM or GBS file could not be read
+)
+
+// frame limit for runs with a stop condition but no -frames or -cycles,
+// about 5 minutes of Game Boy time
+const HEADLESS_MAX_FRAMES = 5 * 60 * 60
+
+// Headless mode runs a ROM without a window, e.g. for test ROMs in CI.
+// It runs until a stop condition (PC value, serial output or memory value)
+// is met or the frame/cycle limit is reached, then exits with a status
+type headlessOptions struct {
+	enabled     bool
+	frames      uint64
+	cycles      uint64
+	untilPC     string
+	untilSerial string
+	untilMemory string
+	screenshot  string
+	scale       int
+	serialLog   string
+}
+
+var headless headlessOptions
+
+func headlessFlags() {
+	flag.BoolVar(&headless.enabled, "headless", false, "run without a window")
+	flag.Uint64Var(&headless.frames, "frames", 0, "headless: stop after this many frames (5 minutes' worth if only a stop condition is given)")
+	flag.Uint64Var(&headless.cycles, "cycles", 0, "headless: stop after this many t-states")
+	flag.StringVar(&headless.untilPC, "until-pc", "", "headless: stop when PC reaches this hex address")
+	flag.StringVar(&headless.untilSerial, "until-serial", "", "headless: stop when the serial output contains this text")
+	flag.StringVar(&headless.untilMemory, "until-mem", "", "headless: stop when memory matches ADDR=VALUE (hex)")
+	flag.StringVar(&headless.screenshot, "screenshot", "", "headless: write the final frame to this PNG file")
+	flag.IntVar(&headless.scale, "screenshot-scale", 1, "headless: scale factor for the final frame")
+	flag.StringVar(&headless.serialLog, "serial-log", "", "headless: write the serial output to this file")
+}
+
+// parse a hex number with an optional 0x or $ prefix
+func parseHex(value string, bits int) (uint64, error) {
+	value = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(value), "0x"), "$")
+	return strconv.ParseUint(value, 16, bits)
+}
+
+// build the stop condition from the options. Returns nil if there is none
+func (headless *headlessOptions) condition() (func(gbcpu *cpu) bool, error) {
+	var conditions []func(gbcpu *cpu) bool
+
+	if headless.untilPC != "" {
+		pc, err := parseHex(headless.untilPC, 16)
+		if err != nil {
+			return nil, fmt.Errorf("-until-pc: %w", err)
+		}
+		conditions = append(conditions, func(gbcpu *cpu) bool {
+			return gbcpu.pc == uint16(pc)
+		})
+	}
+	if headless.untilSerial != "" {
+		//only search again when more output has arrived
+		text := []byte(headless.untilSerial)
+		searched := -1
+		conditions = append(conditions, func(gbcpu *cpu) bool {
+			if len(gbserial.output) == searched {
+				return false
+			}
+			searched = len(gbserial.output)
+			return bytes.Contains(gbserial.output, text)
+		})
+	}
+	if headless.untilMemory != "" {
+		address, value, found := strings.Cut(headless.untilMemory, "=")
+		if !found {
+			return nil, fmt.Errorf("-until-mem: expected ADDR=VALUE, got %q", headless.untilMemory)
+		}
+		a, err := parseHex(address, 16)
+		if err != nil {
+			return nil, fmt.Errorf("-until-mem: %w", err)
+		}
+		v, err := parseHex(value, 8)
+		if err != nil {
+			return nil, fmt.Errorf("-until-mem: %w", err)
+		}
+		conditions = append(conditions, func(gbcpu *cpu) bool {
+			return gbmmu.readByte(uint16(a)) == byte(v)
+		})
+	}
+
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+	return func(gbcpu *cpu) bool {
+		for _, condition := range conditions {
+			if condition(gbcpu) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// run the ROM without a window and return the exit status
+func runHeadless() int {
+	condition, err := headless.condition()
+	if err != nil {
+		fmt.Println(err)
+		return EXIT_BAD_OPTIONS
+	}
+	if headless.frames == 0 && headless.cycles == 0 {
+		if condition == nil {
+			fmt.Println("Headless mode needs -frames, -cycles or a stop condition")
+			return EXIT_BAD_OPTIONS
+		}
+		//a condition that never comes true would otherwise run forever
+		headless.frames = HEADLESS_MAX_FRAMES
+	}
+
+	gbcpu := cpu{}
+	if err := powerOn(&gbcpu); err != nil {
+		fmt.Printf("Unable to load ROM: %v\n", err)
+		return EXIT_LOAD_FAILED
+	}
+	if headless.screenshot != "" {
+		gbppu.sink = newImageSink(headless.screenshot, headless.scale)
+	} else {
+		gbppu.sink = &headlessSink{}
+	}
+	if recordPath != "" {
+		if err := startRecording(recordPath); err != nil {
+			fmt.Println(err)
+			return EXIT_BAD_OPTIONS
+		}
+	}
+	if wavPath != "" {
+		if err := startWavRecording(wavPath); err != nil {
+			fmt.Println(err)
+			return EXIT_BAD_OPTIONS
+		}
+	}
+
+	status := EXIT_CONDITION_MET
+	for {
+		gbcpu.step()
+		if condition != nil && condition(&gbcpu) {
+			break
+		}
+		//there is no joypad input to wake a STOP without a window
+		if gbcpu.stopped {
+			fmt.Println("CPU stopped by STOP")
+			if condition != nil {
+				status = EXIT_LIMIT_REACHED
+			}
+			break
+		}
+		if headless.frames > 0 && gbppu.frameCount >= headless.frames ||
+			headless.cycles > 0 && totalCycles >= headless.cycles {
+			if condition != nil {
+				status = EXIT_LIMIT_REACHED
+			}
+			break
+		}
+	}
+
+	fmt.Printf("Stopped at PC=%04X after %d frames, %d t-states\n", gbcpu.pc, gbppu.frameCount, totalCycles)
+	if len(gbserial.output) > 0 {
+		fmt.Printf("Serial output: %s\n", gbserial.output)
+	}
+	if headless.serialLog != "" {
+		if err := os.WriteFile(headless.serialLog, gbserial.output, 0644); err != nil {
+			fmt.Printf("Unable to write serial log: %v\n", err)
+		}
+	}
+	if err := stopRecording(); err != nil {
+		fmt.Printf("Unable to finish recording: %v\n", err)
+	}
+	if err := stopWavRecording(); err != nil {
+		fmt.Printf("Unable to finish sound recording: %v\n", err)
+	}
+	if err := gbppu.sink.Close(); err != nil {
+		fmt.Printf("Unable to write screenshot: %v\n", err)
+	}
+	return status
+}
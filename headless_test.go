@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a ROM that plays a tone on the first pulse channel forever
+var TONE_ROM_CODE = []byte{
+	0x3E, 0x80, 0xE0, 0x26, //ld a,$80 : ldh (NR52),a
+	0x3E, 0x77, 0xE0, 0x24, //ld a,$77 : ldh (NR50),a
+	0x3E, 0xFF, 0xE0, 0x25, //ld a,$FF : ldh (NR51),a
+	0x3E, 0x80, 0xE0, 0x11, //ld a,$80 : ldh (NR11),a
+	0x3E, 0xF0, 0xE0, 0x12, //ld a,$F0 : ldh (NR12),a
+	0x3E, 0x00, 0xE0, 0x13, //ld a,$00 : ldh (NR13),a
+	0x3E, 0x87, 0xE0, 0x14, //ld a,$87 : ldh (NR14),a
+	0x18, 0xFE, //jr -2
+}
+
+// write a 32KB ROM with code at the entry point
+func writeTestROM(t *testing.T, code []byte) string {
+	t.Helper()
+	data := make([]byte, rom_end)
+	copy(data[rom_start:], code)
+	path := filepath.Join(t.TempDir(), "test.gb")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// stop the CPU trace, which is logged for every instruction
+func quietLog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+}
+
+// run a ROM headless for a number of frames with the options set up by setup
+func runTestROM(t *testing.T, path string, frames uint64, setup func()) {
+	t.Helper()
+	saved := headless
+	quietLog(t)
+	t.Cleanup(func() {
+		headless = saved
+		gbrom.path = ""
+		wavPath = ""
+		wavStems = false
+	})
+	headless = headlessOptions{enabled: true, frames: frames, scale: 1}
+	gbrom.path = path
+	setup()
+	if status := runHeadless(); status != EXIT_CONDITION_MET {
+		t.Fatalf("headless run exited with %d", status)
+	}
+}
+
+func TestHeadlessWavIsDeterministic(t *testing.T) {
+	rom := writeTestROM(t, TONE_ROM_CODE)
+	dir := t.TempDir()
+	files := []string{"", "_pulse1", "_pulse2", "_wave", "_noise"}
+
+	var first [][]byte
+	for run := 0; run < 2; run++ {
+		base := filepath.Join(dir, string(rune('a'+run)))
+		runTestROM(t, rom, 30, func() {
+			wavPath = base + ".wav"
+			wavStems = true
+		})
+		var outputs [][]byte
+		for _, suffix := range files {
+			data, err := os.ReadFile(base + suffix + ".wav")
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, data)
+		}
+		if run == 0 {
+			first = outputs
+			continue
+		}
+		for i, data := range outputs {
+			if !bytes.Equal(data, first[i]) {
+				t.Errorf("%s.wav differs between runs (%d and %d bytes)", files[i], len(first[i]), len(data))
+			}
+		}
+	}
+	if len(first[0]) <= 44 || bytes.Count(first[0][44:], []byte{0}) == len(first[0])-44 {
+		t.Error("recording is silent")
+	}
+	//only pulse 1 is playing, so its stem is the whole mix
+	if !bytes.Equal(first[1], first[0]) {
+		t.Error("pulse1 stem is out of step with the mix")
+	}
+}
+
+func TestWavStemsStartInStepWithMix(t *testing.T) {
+	quietLog(t)
+	gbrom.path = writeTestROM(t, TONE_ROM_CODE)
+	t.Cleanup(func() {
+		gbrom.path = ""
+	})
+	gbcpu := cpu{}
+	if err := powerOn(&gbcpu); err != nil {
+		t.Fatal(err)
+	}
+	gbppu.sink = &headlessSink{}
+
+	//start part way through a block of samples
+	for gbppu.frameCount < 5 || len(gbapu.samples) == 0 {
+		gbcpu.step()
+	}
+	path := filepath.Join(t.TempDir(), "tone.wav")
+	recorder, err := startAudioRecording(path, AUDIO_RATE_48K, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for gbppu.frameCount < 20 {
+		gbcpu.step()
+	}
+	if err := stopAudioRecording(recorder); err != nil {
+		t.Fatal(err)
+	}
+
+	mix, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stem, err := os.ReadFile(filepath.Join(filepath.Dir(path), "tone_pulse1.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//only pulse 1 is playing, so its stem is the whole mix
+	if !bytes.Equal(stem, mix) {
+		t.Errorf("pulse1 stem (%d bytes) is out of step with the mix (%d bytes)", len(stem), len(mix))
+	}
+}
+
+func TestHeadlessMissingROM(t *testing.T) {
+	saved := headless
+	t.Cleanup(func() {
+		headless = saved
+		gbrom.path = ""
+	})
+	headless = headlessOptions{enabled: true, frames: 1, scale: 1}
+	gbrom.path = filepath.Join(t.TempDir(), "missing.gb")
+	if status := runHeadless(); status != EXIT_LOAD_FAILED {
+		t.Errorf("exit status %d, want %d", status, EXIT_LOAD_FAILED)
+	}
+}
+
+func TestHeadlessUntilSerial(t *testing.T) {
+	quietLog(t)
+	rom := writeTestROM(t, []byte{
+		0x3E, 'O', 0xE0, 0x01, //ld a,'O' : ldh (SB),a
+		0x3E, 0x81, 0xE0, 0x02, //ld a,$81 : ldh (SC),a
+		0x3E, 'K', 0xE0, 0x01, //ld a,'K' : ldh (SB),a
+		0x3E, 0x81, 0xE0, 0x02, //ld a,$81 : ldh (SC),a
+		0x18, 0xFE, //jr -2
+	})
+	saved := headless
+	t.Cleanup(func() {
+		headless = saved
+		gbrom.path = ""
+	})
+	tests := []struct {
+		until  string
+		status int
+	}{
+		{"OK", EXIT_CONDITION_MET},
+		{"NO", EXIT_LIMIT_REACHED},
+	}
+	for _, test := range tests {
+		headless = headlessOptions{enabled: true, frames: 2, untilSerial: test.until, scale: 1}
+		gbrom.path = rom
+		if status := runHeadless(); status != test.status {
+			t.Errorf("until %q: exit status %d, want %d", test.until, status, test.status)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+// interrupt flag (IF) and interrupt enable (IE) registers
+const IF uint16 = 0xFF0F
+const IE uint16 = 0xFFFF
+
+// interrupt bits in IF and IE, in priority order
+const (
+	INT_VBLANK = iota
+	INT_STAT
+	INT_TIMER
+	INT_SERIAL
+	INT_JOYPAD
+)
+
+// request an interrupt by setting its bit in IF
+func requestInterrupt(interrupt int) {
+	gbmmu.memory[IF] |= 1 << interrupt
+}
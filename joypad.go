@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/faiface/pixel/pixelgl"
+)
+
+// The joypad is read through P1 (0xFF00). Writing 0 to bit 4 selects the
+// direction buttons and 0 to bit 5 the action buttons, then the low 4 bits
+// read 0 for each selected button held down. The joypad interrupt is
+// requested when any of the low 4 bits goes from 1 to 0, whether from a
+// press or from selecting a group with a button already held
+
+const (
+	BUTTON_RIGHT = iota
+	BUTTON_LEFT
+	BUTTON_UP
+	BUTTON_DOWN
+	BUTTON_A
+	BUTTON_B
+	BUTTON_SELECT
+	BUTTON_START
+	BUTTON_COUNT
+)
+
+// button names as used in the config file's key bindings
+var BUTTON_NAMES = [BUTTON_COUNT]string{"right", "left", "up", "down", "a", "b", "select", "start"}
+
+var DEFAULT_KEYS = [BUTTON_COUNT]pixelgl.Button{
+	pixelgl.KeyRight, pixelgl.KeyLeft, pixelgl.KeyUp, pixelgl.KeyDown,
+	pixelgl.KeyX, pixelgl.KeyZ, pixelgl.KeyRightShift, pixelgl.KeyEnter,
+}
+
+// the key for each button, from DEFAULT_KEYS and the config
+var keyBindings = DEFAULT_KEYS
+
+type joypad struct {
+	pressed [BUTTON_COUNT]bool
+	lines   byte //P14 and P15 as last written
+	inputs  byte //low 4 bits of P1 as last seen, for spotting falling edges
+}
+
+var gbjoypad joypad
+
+func (gbjoypad *joypad) initialise() {
+	*gbjoypad = joypad{lines: 0x30, inputs: 0x0F}
+}
+
+// get the low 4 bits of P1 - 0 for each selected button held down. The
+// action buttons sit 4 above the directions
+func (gbjoypad *joypad) selected() byte {
+	value := byte(0x0F)
+	for button, pressed := range gbjoypad.pressed {
+		group := button / 4
+		if pressed && !isBitSet(gbjoypad.lines, 4+group) {
+			value &^= 1 << (button % 4)
+		}
+	}
+	return value
+}
+
+func (gbjoypad *joypad) read() byte {
+	return 0xC0 | gbjoypad.lines | gbjoypad.selected()
+}
+
+func (gbjoypad *joypad) write(value byte) {
+	gbjoypad.lines = value & 0x30
+	gbjoypad.update()
+}
+
+// press or release a button
+func (gbjoypad *joypad) setPressed(button int, pressed bool) {
+	gbjoypad.pressed[button] = pressed
+	gbjoypad.update()
+}
+
+// request the joypad interrupt if any input line has gone low
+func (gbjoypad *joypad) update() {
+	inputs := gbjoypad.selected()
+	if gbjoypad.inputs&^inputs != 0 {
+		requestInterrupt(INT_JOYPAD)
+	}
+	gbjoypad.inputs = inputs
+}
+
+// read the buttons from the keyboard
+func (gbjoypad *joypad) poll(win *pixelgl.Window) {
+	for button, key := range keyBindings {
+		if pressed := win.Pressed(key); pressed != gbjoypad.pressed[button] {
+			gbjoypad.setPressed(button, pressed)
+		}
+	}
+}
+
+// set key bindings from the config, a map of button name to key name
+// (pixelgl's names, e.g. "Up", "X", "Enter", "RightShift"). Buttons left
+// out or given an unknown key keep their default keys
+func bindKeys(bindings map[string]string) error {
+	var errs []error
+	for name, keyName := range bindings {
+		button := -1
+		for i, buttonName := range BUTTON_NAMES {
+			if strings.EqualFold(name, buttonName) {
+				button = i
+			}
+		}
+		if button < 0 {
+			errs = append(errs, fmt.Errorf("unknown joypad button %q", name))
+			continue
+		}
+		key, err := keyByName(keyName)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		keyBindings[button] = key
+	}
+	return errors.Join(errs...)
+}
+
+// find a key by its pixelgl name (case insensitive)
+func keyByName(name string) (pixelgl.Button, error) {
+	for key := pixelgl.KeyUnknown + 1; key <= pixelgl.KeyLast; key++ {
+		if strings.EqualFold(key.String(), name) {
+			return key, nil
+		}
+	}
+	return pixelgl.KeyUnknown, fmt.Errorf("unknown key %q", name)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+)
+
+// Layer toggles hide the background, window or sprites while the renderers
+// draw, without touching LCDC, to help track down rendering bugs. A hidden
+// background or window is drawn as colour 0 and never hides sprites.
+// Highlighting tints each pixel with the colour of the layer it came from.
+// (On the SGB, colours are applied after rendering so there is no tint)
+
+const (
+	LAYER_BG = iota
+	LAYER_WINDOW
+	LAYER_OBJ
+	LAYER_COUNT
+)
+
+var LAYER_NAMES = [LAYER_COUNT]string{"background", "window", "sprites"}
+var LAYER_TINTS = [LAYER_COUNT]color.RGBA{
+	{0xFF, 0x40, 0x40, 0xFF},
+	{0x40, 0xFF, 0x40, 0xFF},
+	{0x40, 0x60, 0xFF, 0xFF},
+}
+
+type layers struct {
+	hidden    [LAYER_COUNT]bool
+	highlight bool
+}
+
+var gblayers layers
+
+// check whether a layer is drawn
+func (gblayers *layers) shown(layer int) bool {
+	return !gblayers.hidden[layer]
+}
+
+// show or hide a layer
+func (gblayers *layers) setShown(layer int, shown bool) {
+	gblayers.hidden[layer] = !shown
+}
+
+func (gblayers *layers) toggle(layer int) {
+	gblayers.hidden[layer] = !gblayers.hidden[layer]
+	fmt.Printf("Layer %s: %v\n", LAYER_NAMES[layer], gblayers.shown(layer))
+}
+
+func (gblayers *layers) setHighlight(highlight bool) {
+	gblayers.highlight = highlight
+}
+
+func (gblayers *layers) toggleHighlight() {
+	gblayers.highlight = !gblayers.highlight
+	fmt.Printf("Layer highlight: %v\n", gblayers.highlight)
+}
+
+// tint a pixel with its layer's colour when highlighting
+func (gblayers *layers) tint(layer int, c color.RGBA) color.RGBA {
+	if !gblayers.highlight {
+		return c
+	}
+	return mixColour(c, LAYER_TINTS[layer], 1, 2)
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/hex"
+	"flag"
 	"fmt"
 	_ "image/png"
+	"io"
 	"log"
 	"os"
 
@@ -27,12 +29,26 @@ const boot_rom string = "31FEFFAF21FF9F32CB7C20FB2126FF0E113E8032E20C3EF3E2323E7
 
 var tstates uint16
 
+// t-states run since power on
+var totalCycles uint64
+
+// file to record video to from power on (see record.go)
+var recordPath string
+
+// file to record sound to from power on, and whether to write per-channel stems (see wavrecord.go)
+var wavPath string
+var wavStems bool
+
+// GBS track to start on, 1 based, or 0 for the file's first song (see gbs.go)
+var gbsTrack int
+
 type cpu struct {
 	a, b, c, d, e, h, l byte
 	f                   Bits
 	pc, sp              uint16
 	opcodes             map[uint16]string
 	cb_prefix           bool
+	stopped             bool //in STOP's low power mode until a joypad line goes low
 }
 
 type Bits uint8
@@ -74,8 +90,7 @@ func (gbcpu *cpu) initialise() {
 		// 0x01
 		0x0010: "stop_0", 0x0011: "ld_de_d16", 0x0012: "ld_de_a", 0x0013: "inc_de",
 		0x0014: "inc_d", 0x0015: "dec_d", 0x0016: "ld_d_d8", 0x0017: "rla",
-		0x0018: "jr_r8", 0x0019: "add_hl_de", 0x001A: "ld_a_de",
-		/*"dec_de": 0x1B, */
+		0x0018: "jr_r8", 0x0019: "add_hl_de", 0x001A: "ld_a_de", 0x001B: "dec_de",
 		0x001C: "inc_e", 0x001D: "dec_e", 0x001E: "ld_e_d8", 0x001F: "rra",
 		// 0x20
 		0x0020: "jr_nz_r8", 0x0021: "ld_hl_d16", 0x0022: "ld_hl_plus_a", 0x0023: "inc_hl",
@@ -83,11 +98,12 @@ func (gbcpu *cpu) initialise() {
 		0x0028: "jr_z_r8", 0x0029: "add_hl_hl", 0x002A: "ld_a_hl_plus", 0x002B: "dec_hl",
 		0x002C: "inc_l", 0x002D: "dec_l", 0x002E: "ld_l_d8", 0x002F: "cpl",
 		// 0x30
-		0x0030: "jr_nc_r8", 0x0031: "ld_sp_d16", 0x0032: "ld_hl_minus_a",
-		/*:inc_sp, :inc__hl, */
+		0x0030: "jr_nc_r8", 0x0031: "ld_sp_d16", 0x0032: "ld_hl_minus_a", 0x0033: "inc_sp",
+		/*:inc__hl, */
 		0x0035: "dec__hl", 0x0036: "ld_hl_d8",
 		/*:scf,
-		  :jr_c_r8, :add_hl_sp, :ld_a_hl_minus, :dec_sp, */
+		  :jr_c_r8, :add_hl_sp, */
+		0x003A: "ld_a_hl_minus", 0x003B: "dec_sp",
 		0x003C: "inc_a",
 		0x003D: "dec_a", 0x003E: "ld_a_d8",
 		// 0x40
@@ -291,28 +307,20 @@ func getmsb(word uint16) byte {
 }
 
 func isBitSet(value byte, bit int) bool {
-	switch bit {
-	case 0:
-	case 1:
-		return (value & 0b00000001) > 0
-	case 7:
-		return (value & 0b10000000) > 0
-	default:
-	}
-	return false
+	return value&(1<<bit) != 0
 }
 
 // fetch next instruction at the program counter (PC)
 func (gbcpu *cpu) fetch() byte {
+	//fetchByte accounts for the t-states of the read
 	var opcode byte = gbmmu.fetchByte(gbcpu.pc)
 	gbcpu.pc++
-	tstates += 4
 
 	return opcode
 }
 
 // execute a clock cycle
-func (gbcpu *cpu) tick(gbmmu mmu, gbppu ppu) {
+func (gbcpu *cpu) tick() {
 	//get the opcode at the current program counter (PC)
 	//var opcode byte = gbmmu.memory[gbcpu.pc]
 	//var asm string
@@ -354,6 +362,8 @@ func (gbcpu *cpu) tick(gbmmu mmu, gbppu ppu) {
 			gbcpu.dec_c()
 		case 0x0E:
 			gbcpu.ld_c_d8()
+		case 0x10:
+			gbcpu.stop_0()
 		case 0x11:
 			gbcpu.ld_de_d16()
 		case 0x12:
@@ -374,6 +384,8 @@ func (gbcpu *cpu) tick(gbmmu mmu, gbppu ppu) {
 			gbcpu.add_hl_de()
 		case 0x1A:
 			gbcpu.ld_a_de()
+		case 0x1B:
+			gbcpu.dec_de()
 		case 0x1C:
 			gbcpu.inc_e()
 		case 0x1D:
@@ -420,10 +432,16 @@ func (gbcpu *cpu) tick(gbmmu mmu, gbppu ppu) {
 			gbcpu.ld_sp_d16()
 		case 0x32:
 			gbcpu.ld_hl_minus_a()
+		case 0x33:
+			gbcpu.inc_sp()
 		case 0x35:
 			gbcpu.dec__hl()
 		case 0x36:
 			gbcpu.ld_hl_d8()
+		case 0x3A:
+			gbcpu.ld_a_hl_minus()
+		case 0x3B:
+			gbcpu.dec_sp()
 		case 0x3C:
 			gbcpu.inc_a()
 		case 0x3D:
@@ -624,6 +642,7 @@ func (gbcpu *cpu) ld_bc_a() {
 // 0x0003
 func (gbcpu *cpu) inc_bc() {
 	var bc uint16 = 256*uint16(gbcpu.b) + uint16(gbcpu.c)
+	gbppu.corruptOAM(bc, OAM_CORRUPT_WRITE)
 	bc++
 	gbcpu.b = uint8(bc >> 8)
 	gbcpu.c = uint8(bc & 0xFF)
@@ -678,7 +697,8 @@ func (gbcpu *cpu) ld_b_d8() {
 // 0x000B
 func (gbcpu *cpu) dec_bc() {
 	var bc uint16 = 256*uint16(gbcpu.b) + uint16(gbcpu.c)
-	bc++
+	gbppu.corruptOAM(bc, OAM_CORRUPT_WRITE)
+	bc--
 	gbcpu.b = uint8(bc >> 8)
 	gbcpu.c = uint8(bc & 0xFF)
 	debugLog(fmt.Sprintf("bc is %02x%02x\n", gbcpu.b, gbcpu.c), DEBUG_VAR)
@@ -725,6 +745,17 @@ func (gbcpu *cpu) ld_c_d8() {
 	gbcpu.c = gbcpu.fetch()
 }
 
+// 0x0010
+func (gbcpu *cpu) stop_0() {
+	//STOP is followed by a padding byte
+	gbcpu.fetch()
+	if !gbspeed.stop() {
+		//low power mode - the clock stops, and DIV is reset, until a button is pressed
+		gbtimer.resetDIV()
+		gbcpu.stopped = true
+	}
+}
+
 // 0x0011
 func (gbcpu *cpu) ld_de_d16() {
 	//LSB first
@@ -744,6 +775,7 @@ func (gbcpu *cpu) ld_de_a() {
 func (gbcpu *cpu) inc_de() {
 	//var de uint16 = 256*uint16(gbcpu.d) + uint16(gbcpu.e)
 	var de = makeWord(gbcpu.d, gbcpu.e)
+	gbppu.corruptOAM(de, OAM_CORRUPT_WRITE)
 
 	de++
 	gbcpu.d = uint8(de >> 8)
@@ -848,6 +880,18 @@ func (gbcpu *cpu) ld_a_de() {
 	gbcpu.a = gbmmu.fetchByte(de)
 }
 
+// 0x001B
+// 16-bit decrement does not affect flags
+func (gbcpu *cpu) dec_de() {
+	var de = makeWord(gbcpu.d, gbcpu.e)
+	gbppu.corruptOAM(de, OAM_CORRUPT_WRITE)
+
+	de--
+	gbcpu.d = getmsb(de)
+	gbcpu.e = getlsb(de)
+	debugLog(fmt.Sprintf("de is %02x%02x\n", gbcpu.d, gbcpu.e), DEBUG_VAR)
+}
+
 // 0x001C
 func (gbcpu *cpu) inc_e() {
 	//reset all flags implemented by this instruction
@@ -943,15 +987,19 @@ func (gbcpu *cpu) ld_hl_d16() {
 // 0x0022
 func (gbcpu *cpu) ld_hl_plus_a() {
 	var hl = makeWord(gbcpu.h, gbcpu.l)
+	//the write and the increment share a cycle so OAM is only corrupted once
 	gbmmu.storeByte(hl, gbcpu.a)
 
-	gbcpu.inc_hl()
+	hl++
+	gbcpu.h = getmsb(hl)
+	gbcpu.l = getlsb(hl)
 }
 
 // 0x0023
 // note 16-bit increments do not affect flags
 func (gbcpu *cpu) inc_hl() {
 	var hl uint16 = 256*uint16(gbcpu.h) + uint16(gbcpu.l)
+	gbppu.corruptOAM(hl, OAM_CORRUPT_WRITE)
 
 	hl++
 	gbcpu.h = uint8(hl >> 8)
@@ -1099,15 +1147,19 @@ func (gbcpu *cpu) add_hl_hl() {
 func (gbcpu *cpu) ld_a_hl_plus() {
 	var hl = makeWord(gbcpu.h, gbcpu.l)
 	//var hl uint16 = 256*uint16(gbcpu.h) + uint16(gbcpu.l)
-	gbcpu.a = gbmmu.fetchByte(hl)
+	gbppu.corruptOAM(hl, OAM_CORRUPT_INCREMENT_READ)
+	gbcpu.a = gbmmu.fetchUncorrupted(hl)
 
-	gbcpu.inc_hl()
+	hl++
+	gbcpu.h = getmsb(hl)
+	gbcpu.l = getlsb(hl)
 }
 
 // 0x002B
 // 16-bit decrements do not affect flags
 func (gbcpu *cpu) dec_hl() {
 	var hl = makeWord(gbcpu.h, gbcpu.l)
+	gbppu.corruptOAM(hl, OAM_CORRUPT_WRITE)
 
 	hl--
 	gbcpu.h = uint8(hl >> 8)
@@ -1190,8 +1242,19 @@ func (gbcpu *cpu) ld_sp_d16() {
 // 0x0032
 func (gbcpu *cpu) ld_hl_minus_a() {
 	var hl = makeWord(gbcpu.h, gbcpu.l)
+	//the write and the decrement share a cycle so OAM is only corrupted once
 	gbmmu.storeByte(hl, gbcpu.a)
-	gbcpu.dec_hl()
+
+	hl--
+	gbcpu.h = getmsb(hl)
+	gbcpu.l = getlsb(hl)
+}
+
+// 0x0033
+// 16-bit increment does not affect flags
+func (gbcpu *cpu) inc_sp() {
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_WRITE)
+	gbcpu.sp++
 }
 
 // 0x0035
@@ -1226,6 +1289,24 @@ func (gbcpu *cpu) ld_hl_d8() {
 	gbmmu.storeByte(hl, d8)
 }
 
+// 0x003A
+func (gbcpu *cpu) ld_a_hl_minus() {
+	var hl = makeWord(gbcpu.h, gbcpu.l)
+	gbppu.corruptOAM(hl, OAM_CORRUPT_INCREMENT_READ)
+	gbcpu.a = gbmmu.fetchUncorrupted(hl)
+
+	hl--
+	gbcpu.h = getmsb(hl)
+	gbcpu.l = getlsb(hl)
+}
+
+// 0x003B
+// 16-bit decrement does not affect flags
+func (gbcpu *cpu) dec_sp() {
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_WRITE)
+	gbcpu.sp--
+}
+
 // 0x003C
 func (gbcpu *cpu) inc_a() {
 	//reset all flags implemented by this instruction
@@ -1599,10 +1680,12 @@ func (gbcpu *cpu) cp_hl() {
 
 // 0x00C1
 func (gbcpu *cpu) pop_bc() {
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 	gbcpu.sp++
-	gbcpu.b = gbmmu.fetchByte(gbcpu.sp)
+	gbcpu.b = gbmmu.fetchUncorrupted(gbcpu.sp)
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 	gbcpu.sp++
-	gbcpu.c = gbmmu.fetchByte(gbcpu.sp)
+	gbcpu.c = gbmmu.fetchUncorrupted(gbcpu.sp)
 	debugLog(fmt.Sprintf("popped bc as %02x%02x\n", gbcpu.b, gbcpu.c), DEBUG_PUSHPOP)
 }
 
@@ -1641,9 +1724,10 @@ func (gbcpu *cpu) call_nz_a16() {
 
 		//push current PC onto stack
 		debugLog(fmt.Sprintf("PC: %04x LSB %02x MSB %02x\n", gbcpu.pc, getlsb(gbcpu.pc), getmsb(gbcpu.pc)), DEBUG_VAR)
-		gbmmu.storeByte(gbcpu.sp, getlsb(gbcpu.pc))
+		gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_WRITE)
+		gbmmu.storeUncorrupted(gbcpu.sp, getlsb(gbcpu.pc))
 		gbcpu.sp--
-		gbmmu.storeByte(gbcpu.sp, getmsb(gbcpu.pc))
+		gbmmu.storeUncorrupted(gbcpu.sp, getmsb(gbcpu.pc))
 		gbcpu.sp--
 
 		//jump to new location
@@ -1655,9 +1739,10 @@ func (gbcpu *cpu) call_nz_a16() {
 // 0x00C5
 func (gbcpu *cpu) push_bc() {
 	debugLog(fmt.Sprintf("pushing bc as %02x%02x\n", gbcpu.b, gbcpu.c), DEBUG_PUSHPOP)
-	gbmmu.storeByte(gbcpu.sp, gbcpu.c)
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_WRITE)
+	gbmmu.storeUncorrupted(gbcpu.sp, gbcpu.c)
 	gbcpu.sp--
-	gbmmu.storeByte(gbcpu.sp, gbcpu.b)
+	gbmmu.storeUncorrupted(gbcpu.sp, gbcpu.b)
 	gbcpu.sp--
 }
 
@@ -1695,10 +1780,12 @@ func (gbcpu *cpu) add_a_d8() {
 // 0x00C8
 func (gbcpu *cpu) ret_z() {
 	if Has(gbcpu.f, Z) {
+		gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 		gbcpu.sp++
-		msb := gbmmu.fetchByte(gbcpu.sp)
+		msb := gbmmu.fetchUncorrupted(gbcpu.sp)
+		gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 		gbcpu.sp++
-		lsb := gbmmu.fetchByte(gbcpu.sp)
+		lsb := gbmmu.fetchUncorrupted(gbcpu.sp)
 		gbcpu.pc = makeWord(msb, lsb)
 		debugLog(fmt.Sprintf("Return popped to PC as %04x\n", gbcpu.pc), DEBUG_PUSHPOP)
 	}
@@ -1706,10 +1793,12 @@ func (gbcpu *cpu) ret_z() {
 
 // 0x00C9
 func (gbcpu *cpu) ret() {
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 	gbcpu.sp++
-	msb := gbmmu.fetchByte(gbcpu.sp)
+	msb := gbmmu.fetchUncorrupted(gbcpu.sp)
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 	gbcpu.sp++
-	lsb := gbmmu.fetchByte(gbcpu.sp)
+	lsb := gbmmu.fetchUncorrupted(gbcpu.sp)
 	gbcpu.pc = makeWord(msb, lsb)
 	debugLog(fmt.Sprintf("Return popped to PC as %04x\n", gbcpu.pc), DEBUG_PUSHPOP)
 }
@@ -1730,9 +1819,10 @@ func (gbcpu *cpu) call_a16() {
 
 	//push current PC onto stack
 	debugLog(fmt.Sprintf("PC: %04x LSB %02x MSB %02x\n", gbcpu.pc, getlsb(gbcpu.pc), getmsb(gbcpu.pc)), DEBUG_VAR)
-	gbmmu.storeByte(gbcpu.sp, getlsb(gbcpu.pc))
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_WRITE)
+	gbmmu.storeUncorrupted(gbcpu.sp, getlsb(gbcpu.pc))
 	gbcpu.sp--
-	gbmmu.storeByte(gbcpu.sp, getmsb(gbcpu.pc))
+	gbmmu.storeUncorrupted(gbcpu.sp, getmsb(gbcpu.pc))
 	gbcpu.sp--
 
 	//jump to new location
@@ -1788,10 +1878,12 @@ func (gbcpu *cpu) adc_a_d8() {
 // 0x00D0
 func (gbcpu *cpu) ret_nc() {
 	if !Has(gbcpu.f, C) {
+		gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 		gbcpu.sp++
-		msb := gbmmu.fetchByte(gbcpu.sp)
+		msb := gbmmu.fetchUncorrupted(gbcpu.sp)
+		gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 		gbcpu.sp++
-		lsb := gbmmu.fetchByte(gbcpu.sp)
+		lsb := gbmmu.fetchUncorrupted(gbcpu.sp)
 		gbcpu.pc = makeWord(msb, lsb)
 		debugLog(fmt.Sprintf("Return popped to PC as %04x\n", gbcpu.pc), DEBUG_PUSHPOP)
 	}
@@ -1799,19 +1891,22 @@ func (gbcpu *cpu) ret_nc() {
 
 // 0x00D1
 func (gbcpu *cpu) pop_de() {
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 	gbcpu.sp++
-	gbcpu.d = gbmmu.fetchByte(gbcpu.sp)
+	gbcpu.d = gbmmu.fetchUncorrupted(gbcpu.sp)
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 	gbcpu.sp++
-	gbcpu.e = gbmmu.fetchByte(gbcpu.sp)
+	gbcpu.e = gbmmu.fetchUncorrupted(gbcpu.sp)
 	debugLog(fmt.Sprintf("popped de as %02x%02x\n", gbcpu.d, gbcpu.e), DEBUG_PUSHPOP)
 }
 
 // 0x00D5
 func (gbcpu *cpu) push_de() {
 	debugLog(fmt.Sprintf("pushing de as %02x%02x\n", gbcpu.d, gbcpu.e), DEBUG_PUSHPOP)
-	gbmmu.storeByte(gbcpu.sp, gbcpu.e)
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_WRITE)
+	gbmmu.storeUncorrupted(gbcpu.sp, gbcpu.e)
 	gbcpu.sp--
-	gbmmu.storeByte(gbcpu.sp, gbcpu.d)
+	gbmmu.storeUncorrupted(gbcpu.sp, gbcpu.d)
 	gbcpu.sp--
 }
 
@@ -1849,10 +1944,12 @@ func (gbcpu *cpu) sub_d8() {
 // 0x00D8
 func (gbcpu *cpu) ret_c() {
 	if Has(gbcpu.f, C) {
+		gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 		gbcpu.sp++
-		msb := gbmmu.fetchByte(gbcpu.sp)
+		msb := gbmmu.fetchUncorrupted(gbcpu.sp)
+		gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 		gbcpu.sp++
-		lsb := gbmmu.fetchByte(gbcpu.sp)
+		lsb := gbmmu.fetchUncorrupted(gbcpu.sp)
 		gbcpu.pc = makeWord(msb, lsb)
 		debugLog(fmt.Sprintf("Return popped to PC as %04x\n", gbcpu.pc), DEBUG_PUSHPOP)
 	}
@@ -1867,10 +1964,12 @@ func (gbcpu *cpu) ldh_a8_a() {
 
 // 0x00E1
 func (gbcpu *cpu) pop_hl() {
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 	gbcpu.sp++
-	gbcpu.h = gbmmu.fetchByte(gbcpu.sp)
+	gbcpu.h = gbmmu.fetchUncorrupted(gbcpu.sp)
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 	gbcpu.sp++
-	gbcpu.l = gbmmu.fetchByte(gbcpu.sp)
+	gbcpu.l = gbmmu.fetchUncorrupted(gbcpu.sp)
 	debugLog(fmt.Sprintf("popped hl as %02x%02x\n", gbcpu.h, gbcpu.l), DEBUG_PUSHPOP)
 }
 
@@ -1882,9 +1981,10 @@ func (gbcpu *cpu) ld_dc_a() {
 // 0x00E5
 func (gbcpu *cpu) push_hl() {
 	debugLog(fmt.Sprintf("pushing hl as %02x%02x\n", gbcpu.h, gbcpu.l), DEBUG_PUSHPOP)
-	gbmmu.storeByte(gbcpu.sp, gbcpu.l)
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_WRITE)
+	gbmmu.storeUncorrupted(gbcpu.sp, gbcpu.l)
 	gbcpu.sp--
-	gbmmu.storeByte(gbcpu.sp, gbcpu.h)
+	gbmmu.storeUncorrupted(gbcpu.sp, gbcpu.h)
 	gbcpu.sp--
 }
 
@@ -1943,9 +2043,10 @@ func (gbcpu *cpu) xor_d8() {
 func (gbcpu *cpu) rst_28h() {
 	//push current PC onto stack
 	debugLog(fmt.Sprintf("PC: %04x LSB %02x MSB %02x\n", gbcpu.pc, getlsb(gbcpu.pc), getmsb(gbcpu.pc)), DEBUG_VAR)
-	gbmmu.storeByte(gbcpu.sp, getlsb(gbcpu.pc))
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_WRITE)
+	gbmmu.storeUncorrupted(gbcpu.sp, getlsb(gbcpu.pc))
 	gbcpu.sp--
-	gbmmu.storeByte(gbcpu.sp, getmsb(gbcpu.pc))
+	gbmmu.storeUncorrupted(gbcpu.sp, getmsb(gbcpu.pc))
 	gbcpu.sp--
 
 	//jump to new location
@@ -1967,10 +2068,12 @@ func (gbcpu *cpu) ldh_a_a8() {
 
 // 0x00F1
 func (gbcpu *cpu) pop_af() {
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 	gbcpu.sp++
-	gbcpu.a = gbmmu.fetchByte(gbcpu.sp)
+	gbcpu.a = gbmmu.fetchUncorrupted(gbcpu.sp)
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_INCREMENT_READ)
 	gbcpu.sp++
-	getFlag := gbmmu.fetchByte(gbcpu.sp)
+	getFlag := gbmmu.fetchUncorrupted(gbcpu.sp)
 	if gbcpu.a == 0x00 && getFlag == 0x10 {
 		debugLog(fmt.Sprintf("popped f as %02x\n", getFlag), DEBUG_PUSHPOP)
 	}
@@ -1989,9 +2092,10 @@ func (gbcpu *cpu) di() {
 // 0x00F5
 func (gbcpu *cpu) push_af() {
 	debugLog(fmt.Sprintf("pushing af as %02x%02x\n", gbcpu.a, gbcpu.f), DEBUG_PUSHPOP)
-	gbmmu.storeByte(gbcpu.sp, byte(gbcpu.f))
+	gbppu.corruptOAM(gbcpu.sp, OAM_CORRUPT_WRITE)
+	gbmmu.storeUncorrupted(gbcpu.sp, byte(gbcpu.f))
 	gbcpu.sp--
-	gbmmu.storeByte(gbcpu.sp, gbcpu.a)
+	gbmmu.storeUncorrupted(gbcpu.sp, gbcpu.a)
 	gbcpu.sp--
 }
 
@@ -2199,6 +2303,10 @@ func (gbcpu *cpu) status() {
 	//Set flags to expected value after boot rom completes
 	if gbcpu.pc == 0x100 {
 		gbcpu.a = 0x01
+		//games check for A=0x11 to detect CGB hardware
+		if gbcgb.enabled {
+			gbcpu.a = 0x11
+		}
 		gbcpu.f = 0xB0
 		gbcpu.b = 0x00
 		gbcpu.c = 0x13
@@ -2220,25 +2328,130 @@ func (gbcpu *cpu) status() {
 		outlog += fmt.Sprintf("L:%02X ", gbcpu.l)
 		outlog += fmt.Sprintf("SP:%04X ", gbcpu.sp)
 		outlog += fmt.Sprintf("PC:%04X ", gbcpu.pc)
-		outlog += fmt.Sprintf("PCMEM:%02X,", gbmmu.fetchByte(gbcpu.pc))
-		outlog += fmt.Sprintf("%02X,", gbmmu.fetchByte(gbcpu.pc+1))
-		outlog += fmt.Sprintf("%02X,", gbmmu.fetchByte(gbcpu.pc+2))
-		outlog += fmt.Sprintf("%02X", gbmmu.fetchByte(gbcpu.pc+3))
+		outlog += fmt.Sprintf("PCMEM:%02X,", gbmmu.readByte(gbcpu.pc))
+		outlog += fmt.Sprintf("%02X,", gbmmu.readByte(gbcpu.pc+1))
+		outlog += fmt.Sprintf("%02X,", gbmmu.readByte(gbcpu.pc+2))
+		outlog += fmt.Sprintf("%02X", gbmmu.readByte(gbcpu.pc+3))
 
 		log.Print(outlog)
 	}
 }
 
-func run() {
-	//gbmmu is global
-	gbcpu := cpu{}
-	gbppu := ppu{}
-	gbrom := rom{}
+// run the rest of the machine for the t-states the CPU has used since the last call
+func clockPeripherals() {
+	cycles := tstates
+	tstates = 0
+	totalCycles += uint64(cycles)
+	gbdma.step(cycles)
+	gbtimer.step(cycles)
+	gbppu.step(gbspeed.dots(cycles))
+	gbapu.step(gbspeed.dots(cycles))
+}
 
-	//initialise cpu, ppu, rom
+// handle the emulator's own keys
+func hotkeys(win *pixelgl.Window) {
+	//cycle through the colour schemes
+	if win.JustPressed(pixelgl.KeyP) {
+		nextColourScheme()
+	}
+	//switch between the scanline and pixel FIFO renderers
+	if win.JustPressed(pixelgl.KeyR) {
+		gbppu.toggleRenderer()
+	}
+	//cycle through the scaling filters
+	if win.JustPressed(pixelgl.KeyF) {
+		nextFilter()
+	}
+	//show or hide the background, window and sprite layers, or highlight them
+	if win.JustPressed(pixelgl.Key1) {
+		gblayers.toggle(LAYER_BG)
+	}
+	if win.JustPressed(pixelgl.Key2) {
+		gblayers.toggle(LAYER_WINDOW)
+	}
+	if win.JustPressed(pixelgl.Key3) {
+		gblayers.toggle(LAYER_OBJ)
+	}
+	if win.JustPressed(pixelgl.KeyH) {
+		gblayers.toggleHighlight()
+	}
+	//turn LCD ghosting and GBC colour correction off and on
+	if win.JustPressed(pixelgl.KeyG) {
+		gbghosting.toggle()
+	}
+	if win.JustPressed(pixelgl.KeyC) {
+		gbcorrection.toggle()
+	}
+	//turn the VRAM/OAM access restrictions off and on for debugging
+	if win.JustPressed(pixelgl.KeyF2) {
+		gbppu.toggleAccessRestrictions()
+	}
+	//save the current frame as a PNG
+	if win.JustPressed(pixelgl.KeyF12) {
+		screenshotHotkey()
+	}
+	//debug windows
+	if win.JustPressed(pixelgl.KeyF3) {
+		toggleDebugWindow(&gbtileview)
+	}
+	if win.JustPressed(pixelgl.KeyF4) {
+		toggleDebugWindow(&gbmapview)
+	}
+	if win.JustPressed(pixelgl.KeyF5) {
+		toggleDebugWindow(&gboamview)
+	}
+	if win.JustPressed(pixelgl.KeyF6) {
+		toggleDebugWindow(&gbpaletteview)
+	}
+	if win.JustPressed(pixelgl.KeyF7) {
+		toggleDebugWindow(&gbsoundview)
+	}
+	//start or stop recording video or sound
+	if win.JustPressed(pixelgl.KeyF10) {
+		recordHotkey()
+	}
+	if win.JustPressed(pixelgl.KeyF9) {
+		wavHotkey()
+	}
+	//choose the GBS track
+	if gbgbs.enabled && win.JustPressed(pixelgl.KeyLeft) {
+		gbgbs.skipTrack(-1)
+	}
+	if gbgbs.enabled && win.JustPressed(pixelgl.KeyRight) {
+		gbgbs.skipTrack(1)
+	}
+}
+
+// read the emulator's hotkeys and the joypad, and update the debug windows
+func handleInput(win *pixelgl.Window) {
+	hotkeys(win)
+	gbjoypad.poll(win)
+	updateDebugWindows()
+}
+
+// set up the machine and load the ROM
+// power on with the ROM (or GBS file) in gbrom.path, returning an error if it can't be loaded
+func powerOn(gbcpu *cpu) error {
+	//gbmmu, gbppu and gbrom are global, so clear what is left from any
+	//earlier power on - the same ROM should always run the same way
+	totalCycles = 0
+	tstates = 0
+	gbmmu = mmu{}
+	gbppu = ppu{}
+	gbtimer = timer{}
+	gbdma = dma{}
+	gbhdma = hdma{}
+	gbspeed = speed{}
+	gbserial = serial{}
+	gbgbs = gbsPlayer{}
+
+	//initialise cpu, ppu, mmu, rom
 	gbcpu.initialise()
 	gbppu.initialise()
+	gbmmu.initialise()
 	gbrom.initialise()
+	gbapu.initialise()
+	gbjoypad.initialise()
 
 	//load boot.rom
 	boot, err := hex.DecodeString(boot_rom)
@@ -2249,14 +2462,65 @@ func run() {
 		gbmmu.storeByte(uint16(i), byte(op))
 	}
 
-	//load ROM into memory
-	gbrom.load()
+	//GBS music files are played rather than run (see gbs.go)
+	if isGBSFile(gbrom.path) {
+		if err := gbgbs.load(gbrom.path); err != nil {
+			return err
+		}
+		gbcgb.initialise(gbconfig.Model, 0)
+		gbsgb.initialise(gbconfig.Model, false)
+		gbgbs.startTrack(gbcpu, gbgbs.firstTrack())
+		return nil
+	}
+	//load ROM into memory and pick DMG, SGB or CGB hardware to suit it
+	if err := gbrom.load(); err != nil {
+		return err
+	}
+	gbcgb.initialise(gbconfig.Model, gbrom.cgbFlag)
+	gbsgb.initialise(gbconfig.Model, gbrom.supportsSGB())
+
+	//execute clock cycle
+	gbcpu.a = 0xFF
+
+	// REMOVE THIS - FOR TESTING ONLY - IGNORES BOOT ROM
+	gbcpu.pc = 0x100
+	return nil
+}
+
+// run the machine for one instruction, or the GBS player for one step
+func (gbcpu *cpu) step() {
+	if gbgbs.enabled {
+		gbgbs.step(gbcpu)
+		return
+	}
+	gbcpu.execute()
+}
+
+// execute one instruction and run the rest of the machine alongside it
+func (gbcpu *cpu) execute() {
+	if gbcpu.stopped {
+		if gbjoypad.selected() == 0x0F {
+			return
+		}
+		gbcpu.stopped = false
+	}
+	gbcpu.status()
+	gbcpu.tick()
+	clockPeripherals()
+}
 
-	//setup window (GB screen)
+func run() {
+	gbcpu := cpu{}
+	if err := powerOn(&gbcpu); err != nil {
+		fmt.Printf("Unable to load ROM: %v\n", err)
+		return
+	}
+
+	//setup window (GB screen, or the SGB border around it)
+	width, height := outputSize()
 	cfg := pixelgl.WindowConfig{
-		Title: "Pixel Rocks!",
-		//Bounds: pixel.R(0, 0, 256, 256),
-		Bounds: pixel.R(0, 0, float64(SCRWIDTH), float64(SCRHEIGHT)),
+		Title:  "Pixel Rocks!",
+		Bounds: pixel.R(0, 0, float64(width*displayScale), float64(height*displayScale)),
 		VSync:  true,
 	}
 
@@ -2264,30 +2528,58 @@ func run() {
 	if err != nil {
 		panic(err)
 	}
+	gbppu.sink = newPixelSink(win)
+	if recordPath != "" {
+		if err := startRecording(recordPath); err != nil {
+			fmt.Printf("Unable to start recording: %v\n", err)
+		}
+	}
+	rate := gbconfig.AudioRate
+	if rate == 0 {
+		rate = AUDIO_RATE_48K
+	}
+	if err := openAudio(gbconfig.Audio, gbconfig.AudioCommand, rate); err != nil {
+		fmt.Printf("Unable to start sound, carrying on without it: %v\n", err)
+	}
+	if wavPath != "" {
+		if err := startWavRecording(wavPath); err != nil {
+			fmt.Printf("Unable to start sound recording: %v\n", err)
+		}
+	}
+	//finish any recording and stop the sound when the window is closed
+	defer func() {
+		if err := stopRecording(); err != nil {
+			fmt.Printf("Unable to finish recording: %v\n", err)
+		}
+		if err := stopWavRecording(); err != nil {
+			fmt.Printf("Unable to finish sound recording: %v\n", err)
+		}
+		if err := gbaudio.close(); err != nil {
+			fmt.Printf("Unable to stop sound: %v\n", err)
+		}
+	}()
 
 	//game loop
-	//todo
-
-	//execute clock cycle
-	gbcpu.a = 0xFF
-
-	// REMOVE THIS - FOR TESTING ONLY - IGNORES BOOT ROM
-	gbcpu.pc = 0x100
 	for gbcpu.pc <= 65535 {
-		gbcpu.status()
-		gbcpu.tick(gbmmu, gbppu)
-
-		//gbppu.hblank(win)
 		//start := time.Now()
-		if tstates >= 48 {
-			gbppu.processTileMap(win)
-			tstates = 0
-		}
+		gbcpu.step()
 
 		//t := time.Now()
 		//elapsed := t.Sub(start)
 		//fmt.Printf("%s\n", elapsed)
 
+		//the window reads the keyboard in win.Update, which runs each time a frame is
+		//shown (blank frames too while the LCD is off), so check after every one
+		switch {
+		case gbppu.frameReady:
+			gbppu.frameReady = false
+			handleInput(win)
+		case gbcpu.stopped:
+			//no frames come while STOP has the clock stopped, so update the window here
+			win.Update()
+			handleInput(win)
+		}
+
 		if win.Closed() {
 			return
 		}
@@ -2295,19 +2587,44 @@ func run() {
 }
 
 func main() {
+	flag.StringVar(&gbrom.path, "rom", "02-interrupts.gb", "ROM file to run, or GBS music file to play")
+	logPath := flag.String("log", "./gbemu_log", "CPU trace log file, or empty for no log")
+	flag.StringVar(&recordPath, "record", "", "record video from power on to a .gif, .apng or .y4m file")
+	flag.StringVar(&wavPath, "wav", "", "record sound from power on to a WAV file")
+	flag.BoolVar(&wavStems, "stems", false, "also record each sound channel to its own WAV file")
+	flag.IntVar(&gbsTrack, "track", 0, "GBS track to play, from 1 (default the file's first song)")
+	headlessFlags()
+	flag.Parse()
+
 	// log to custom file
-	LOG_FILE := "./gbemu_log"
-	// open log file
-	logFile, err := os.OpenFile(LOG_FILE, os.O_TRUNC|os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		log.Panic(err)
-	}
-	defer logFile.Close()
+	log.SetOutput(io.Discard)
+	if *logPath != "" {
+		// open log file
+		logFile, err := os.OpenFile(*logPath, os.O_TRUNC|os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			log.Panic(err)
+		}
+		defer logFile.Close()
 
-	// Set log out put and enjoy :)
-	log.SetOutput(logFile)
+		// Set log out put and enjoy :)
+		log.SetOutput(logFile)
+	}
 	log.SetFlags(0)
 
+	// load user settings, keeping the defaults for any that are invalid
+	if err := gbconfig.load(CONFIG_FILE); err != nil {
+		fmt.Printf("Unable to load config: %v\n", err)
+	}
+
+	if headless.enabled {
+		status := runHeadless()
+		//os.Exit skips deferred calls, so close the log first
+		if closer, ok := log.Writer().(io.Closer); ok {
+			closer.Close()
+		}
+		os.Exit(status)
+	}
+
 	pixelgl.Run(run)
 
 	fmt.Printf("Program complete\n")
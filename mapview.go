@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// The map viewer draws both 32x32 tile maps (0x9800 and 0x9C00) side by
+// side at 256x256 each, using the tile data and palettes the PPU would use.
+// The part of the background on screen (SCX, SCY) is outlined on the map
+// LCDC bit 3 selects, wrapping round the edges, and the part of the window
+// on screen (from WX, WY) on the map LCDC bit 6 selects
+
+const MAP_SIZE = 256
+
+var VIEWPORT_COLOUR = color.RGBA{0xFF, 0x30, 0x30, 0xFF}
+var WINDOW_COLOUR = color.RGBA{0x30, 0x80, 0xFF, 0xFF}
+
+type mapView struct {
+	image *image.RGBA
+}
+
+var gbmapview mapView
+
+func (view *mapView) name() string {
+	return "Tile maps"
+}
+
+func (view *mapView) render() *image.RGBA {
+	if view.image == nil {
+		view.image = image.NewRGBA(image.Rect(0, 0, MAP_SIZE*2, MAP_SIZE))
+	}
+	lcdc := gbppu.read(gbppu.LCDC)
+	for m, base := range []uint16{0x9800, 0x9C00} {
+		for y := 0; y < MAP_SIZE; y++ {
+			for x := 0; x < MAP_SIZE; x++ {
+				view.image.SetRGBA(m*MAP_SIZE+x, y, mapPixel(lcdc, base, x, y))
+			}
+		}
+	}
+
+	//outline the screen on the background map
+	left := int(tileMapBase(lcdc, 3)-0x9800) / 0x400 * MAP_SIZE
+	scx, scy := int(gbppu.read(gbppu.SCX)), int(gbppu.read(gbppu.SCY))
+	view.outline(left, scx, scy, int(SCRWIDTH), int(SCRHEIGHT), VIEWPORT_COLOUR)
+
+	//and the visible part of the window on the window map
+	wx, wy := int(gbppu.read(WX))-7, int(gbppu.read(WY))
+	if isBitSet(lcdc, 5) && wx < int(SCRWIDTH) && wy < int(SCRHEIGHT) {
+		if wx < 0 {
+			wx = 0
+		}
+		left = int(tileMapBase(lcdc, 6)-0x9800) / 0x400 * MAP_SIZE
+		view.outline(left, 0, 0, int(SCRWIDTH)-wx, int(SCRHEIGHT)-wy, WINDOW_COLOUR)
+	}
+	return view.image
+}
+
+// get the colour of a pixel in a tile map, as the background would show it
+func mapPixel(lcdc byte, base uint16, x, y int) color.RGBA {
+	mapAddress := base + uint16(y/8*32+x/8)
+	attributes := gbppu.bgAttributes(mapAddress)
+	row, column := uint16(y%8), uint16(x%8)
+	if isBitSet(attributes, 6) {
+		row = 7 - row
+	}
+	if isBitSet(attributes, 5) {
+		column = 7 - column
+	}
+	address := tileDataAddress(lcdc, gbppu.vramByte(0, mapAddress), row)
+	bank := attributes >> 3 & 1
+	colour := tileColour(gbppu.vramByte(bank, address), gbppu.vramByte(bank, address+1), column)
+	return gbppu.bgPaletteColour(attributes&7, colour)
+}
+
+// draw a rectangle outline on the map starting at left, wrapping round its edges
+func (view *mapView) outline(left, x, y, width, height int, colour color.RGBA) {
+	plot := func(px, py int) {
+		view.image.SetRGBA(left+px%MAP_SIZE, py%MAP_SIZE, colour)
+	}
+	for i := 0; i < width; i++ {
+		plot(x+i, y)
+		plot(x+i, y+height-1)
+	}
+	for i := 0; i < height; i++ {
+		plot(x, y+i)
+		plot(x+width-1, y+i)
+	}
+}
+
+// describe the map entry at a point: its address, tile number, where the
+// tile data is and, on the CGB, its attributes
+func (view *mapView) describe(x, y int) string {
+	lcdc := gbppu.read(gbppu.LCDC)
+	base := uint16(0x9800 + x/MAP_SIZE*0x400)
+	column, row := x%MAP_SIZE/8, y/8
+	mapAddress := base + uint16(row*32+column)
+	tile := gbppu.vramByte(0, mapAddress)
+	detail := fmt.Sprintf("map 0x%04X (%d,%d) address 0x%04X tile 0x%02X data 0x%04X",
+		base, column, row, mapAddress, tile, tileDataAddress(lcdc, tile, 0))
+	if gbcgb.active() {
+		attributes := gbppu.bgAttributes(mapAddress)
+		detail += fmt.Sprintf(" palette %d bank %d", attributes&7, attributes>>3&1)
+		if isBitSet(attributes, 5) {
+			detail += " x-flip"
+		}
+		if isBitSet(attributes, 6) {
+			detail += " y-flip"
+		}
+		if isBitSet(attributes, 7) {
+			detail += " priority"
+		}
+	}
+	return detail
+}
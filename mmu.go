@@ -6,18 +6,124 @@ var gbmmu mmu
 
 type mmu struct {
 	memory [mem_size]byte
+	//VRAM (0x8000-0x9FFF) has 2 banks and WRAM (0xC000-0xDFFF) 8 banks on the CGB
+	vram     [2][0x2000]byte
+	wram     [8][0x1000]byte
+	vramBank byte
+	wramBank byte
+}
+
+func (gbmmu *mmu) initialise() {
+	gbmmu.vramBank = 0
+	gbmmu.wramBank = 1
 }
 
 func (gbmmu *mmu) fetchByte(address uint16) byte {
+	gbppu.corruptOAM(address, OAM_CORRUPT_READ)
+	return gbmmu.fetchUncorrupted(address)
+}
+
+// fetch for instructions that corrupt OAM their own way, e.g. pop (see access.go)
+func (gbmmu *mmu) fetchUncorrupted(address uint16) byte {
 	tstates += 4
+	if gbdma.blocks(address) || gbppu.blocks(address) {
+		return 0xFF
+	}
+	return gbmmu.readByte(address)
+}
+
+// read memory without using any CPU time, e.g. for logging
+func (gbmmu *mmu) readByte(address uint16) byte {
+	switch {
+	case gbgbs.enabled && address < 0x8000:
+		return gbgbs.readROM(address)
+	case address >= 0x8000 && address < 0xA000:
+		return gbmmu.vram[gbmmu.vramBank][address-0x8000]
+	case address >= 0xC000 && address < 0xFE00:
+		bank, offset := gbmmu.wramAddress(address)
+		return gbmmu.wram[bank][offset]
+	case isAPUAddress(address):
+		return gbapu.read(address)
+	}
+
+	if address == P1 {
+		if gbsgb.enabled {
+			return gbsgb.readP1(gbjoypad.selected())
+		}
+		return gbjoypad.read()
+	}
+	if gbcgb.active() {
+		switch address {
+		case KEY1:
+			return gbspeed.readKEY1()
+		case HDMA1, HDMA2, HDMA3, HDMA4, HDMA5:
+			return gbhdma.read(address)
+		case VBK:
+			return 0xFE | gbmmu.vramBank
+		case SVBK:
+			return 0xF8 | gbmmu.wramBank
+		case BCPS:
+			return gbcgb.bcps | 0x40
+		case BCPD:
+			return gbcgb.readPalette(&gbcgb.bgPalette, gbcgb.bcps)
+		case OCPS:
+			return gbcgb.ocps | 0x40
+		case OCPD:
+			return gbcgb.readPalette(&gbcgb.objPalette, gbcgb.ocps)
+		case OPRI:
+			return 0xFE | gbcgb.opri
+		}
+	}
 	return gbmmu.memory[address]
 }
 
 func (gbmmu *mmu) storeByte(address uint16, value byte) {
+	gbppu.corruptOAM(address, OAM_CORRUPT_WRITE)
+	gbmmu.storeUncorrupted(address, value)
+}
+
+// store for instructions that corrupt OAM their own way, e.g. push (see access.go)
+func (gbmmu *mmu) storeUncorrupted(address uint16, value byte) {
 	tstates += 4
+	if gbdma.blocks(address) || gbppu.blocks(address) {
+		return
+	}
+
+	switch {
+	case gbgbs.enabled && address < 0x8000:
+		//GBS code is ROM, writes can only select a bank
+		gbgbs.writeROM(address, value)
+		return
+	case address >= 0x8000 && address < 0xA000:
+		gbmmu.vram[gbmmu.vramBank][address-0x8000] = value
+		return
+	case address >= 0xC000 && address < 0xFE00:
+		bank, offset := gbmmu.wramAddress(address)
+		gbmmu.wram[bank][offset] = value
+		return
+	}
+
+	if address == gbppu.STAT {
+		//mode and LY=LYC bits are read only
+		value = 0x80 | value&0x78 | gbmmu.memory[address]&0x07
+	}
 	gbmmu.memory[address] = value
+	if isAPUAddress(address) {
+		gbapu.write(address, value)
+	}
 
 	switch address {
+	case P1:
+		gbjoypad.write(value)
+		if gbsgb.enabled {
+			gbsgb.writeP1(value)
+		}
+	case DIV:
+		gbtimer.resetDIV()
+	case DMA:
+		gbdma.start(value)
+	case SC:
+		gbserial.control(value)
 	case 0xFF50:
 		// if DMG rom is turned off, copy the first 256 bytes of the ROM into memory
 		if value > 0 {
@@ -26,7 +132,47 @@ func (gbmmu *mmu) storeByte(address uint16, value byte) {
 				gbmmu.memory[i] = opcode
 			}
 		}
+	case KEY0:
+		gbcgb.writeKEY0(value)
 	default:
 
 	}
+
+	if gbcgb.active() {
+		switch address {
+		case KEY1:
+			gbspeed.writeKEY1(value)
+		case HDMA1, HDMA2, HDMA3, HDMA4, HDMA5:
+			gbhdma.write(address, value)
+		case VBK:
+			gbmmu.vramBank = value & 1
+		case SVBK:
+			//bank 0 cannot be selected for 0xD000-0xDFFF
+			gbmmu.wramBank = value & 7
+			if gbmmu.wramBank == 0 {
+				gbmmu.wramBank = 1
+			}
+		case BCPS:
+			gbcgb.bcps = value & 0xBF
+		case BCPD:
+			gbcgb.writePalette(&gbcgb.bgPalette, &gbcgb.bcps, value)
+		case OCPS:
+			gbcgb.ocps = value & 0xBF
+		case OCPD:
+			gbcgb.writePalette(&gbcgb.objPalette, &gbcgb.ocps, value)
+		case OPRI:
+			gbcgb.opri = value & 1
+		}
+	}
+}
+
+// get the WRAM bank and offset for an address in WRAM or its echo at 0xE000-0xFDFF
+func (gbmmu *mmu) wramAddress(address uint16) (byte, uint16) {
+	if address >= 0xE000 {
+		address -= 0x2000
+	}
+	if address < 0xD000 {
+		return 0, address - 0xC000
+	}
+	return gbmmu.wramBank, address - 0xD000
 }
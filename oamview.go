@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/faiface/pixel/pixelgl"
+)
+
+// The OAM inspector lists all 40 sprites with a thumbnail of each as it
+// would be drawn, and marks how they fare against the 10 sprites per line
+// limit on a selected scanline (moved with the up and down keys): green if
+// drawn, red if dropped. T saves the list as text for bug reports
+
+const OAM_ENTRIES = 40
+const OAM_VIEW_ROWS = 20
+const OAM_ROW_HEIGHT = 18
+const OAM_COLUMN_WIDTH = 248
+
+var OAM_TEXT_COLOUR = color.RGBA{0xE0, 0xE0, 0xE0, 0xFF}
+var OAM_BACKDROP = color.RGBA{0x40, 0x40, 0x40, 0xFF}
+var OAM_DRAWN_COLOUR = color.RGBA{0x30, 0xC0, 0x30, 0xFF}
+var OAM_DROPPED_COLOUR = color.RGBA{0xFF, 0x30, 0x30, 0xFF}
+
+type oamView struct {
+	line  int //scanline to check the sprite limit on
+	image *image.RGBA
+}
+
+var gboamview oamView
+
+// one OAM entry
+type sprite struct {
+	index   int
+	y, x    byte
+	tile    byte
+	flags   byte
+	address uint16
+}
+
+func readSprite(index int) sprite {
+	address := OAM_START + uint16(index)*4
+	return sprite{
+		index:   index,
+		y:       gbppu.read(address),
+		x:       gbppu.read(address + 1),
+		tile:    gbppu.read(address + 2),
+		flags:   gbppu.read(address + 3),
+		address: address,
+	}
+}
+
+// check whether a sprite covers a screen line. Sprite Y is the line + 16
+func (entry sprite) covers(line int, height uint16) bool {
+	return line+16 >= int(entry.y) && line+16 < int(entry.y)+int(height)
+}
+
+// check whether a sprite covering a line is left out by the sprite limit
+func (entry sprite) dropped(line int, height uint16) bool {
+	if !entry.covers(line, height) {
+		return false
+	}
+	for _, address := range gbppu.scanOAM(uint16(line), height) {
+		if address == entry.address {
+			return false
+		}
+	}
+	return true
+}
+
+// count the lines of the screen where the sprite limit leaves a sprite out
+func (entry sprite) droppedLines(height uint16) int {
+	count := 0
+	for line := 0; line < int(SCRHEIGHT); line++ {
+		if entry.dropped(line, height) {
+			count++
+		}
+	}
+	return count
+}
+
+// describe a sprite's palette: OBP0/OBP1 on the DMG, palette and VRAM bank on the CGB
+func (entry sprite) palette() string {
+	if gbcgb.active() {
+		return fmt.Sprintf("P%d B%d", entry.flags&7, entry.flags>>3&1)
+	}
+	return fmt.Sprintf("OBP%d", entry.flags>>4&1)
+}
+
+// list the flags set as letters: B behind background, X and Y flips
+func (entry sprite) flagLetters() string {
+	letters := []byte("---")
+	if isBitSet(entry.flags, 7) {
+		letters[0] = 'B'
+	}
+	if isBitSet(entry.flags, 5) {
+		letters[1] = 'X'
+	}
+	if isBitSet(entry.flags, 6) {
+		letters[2] = 'Y'
+	}
+	return string(letters)
+}
+
+func (view *oamView) name() string {
+	return "OAM"
+}
+
+func (view *oamView) render() *image.RGBA {
+	if view.image == nil {
+		view.image = image.NewRGBA(image.Rect(0, 0, OAM_COLUMN_WIDTH*OAM_ENTRIES/OAM_VIEW_ROWS, OAM_ROW_HEIGHT*OAM_VIEW_ROWS))
+	}
+	fillRect(view.image, view.image.Rect, color.RGBA{0, 0, 0, 0xFF})
+	height := spriteHeight(gbppu.read(gbppu.LCDC))
+	for index := 0; index < OAM_ENTRIES; index++ {
+		entry := readSprite(index)
+		left := index / OAM_VIEW_ROWS * OAM_COLUMN_WIDTH
+		top := index % OAM_VIEW_ROWS * OAM_ROW_HEIGHT
+		view.drawThumbnail(entry, left+2, top+1, height)
+
+		text := fmt.Sprintf("%02d X%3d Y%3d T%02X %s %s", index, entry.x, entry.y, entry.tile, entry.flagLetters(), entry.palette())
+		drawText(view.image, left+14, top+2, text, OAM_TEXT_COLOUR)
+
+		//sprite limit marker for the selected line
+		marker := image.Rect(left+OAM_COLUMN_WIDTH-10, top+5, left+OAM_COLUMN_WIDTH-4, top+11)
+		switch {
+		case entry.dropped(view.line, height):
+			fillRect(view.image, marker, OAM_DROPPED_COLOUR)
+		case entry.covers(view.line, height):
+			fillRect(view.image, marker, OAM_DRAWN_COLOUR)
+		}
+	}
+	return view.image
+}
+
+// draw a sprite's tiles as they would appear, flipped and coloured, over a
+// grey backdrop that shows through colour 0
+func (view *oamView) drawThumbnail(entry sprite, left, top int, height uint16) {
+	fillRect(view.image, image.Rect(left, top, left+8, top+16), OAM_BACKDROP)
+	tile := uint16(entry.tile)
+	if height == 16 {
+		tile &= 0xFE
+	}
+	var bank byte
+	if gbcgb.active() {
+		bank = entry.flags >> 3 & 1
+	}
+	for half := uint16(0); half < height/8; half++ {
+		pixels := gbppu.decodeTile(bank, 0x8000+(tile+half)*16)
+		for row := 0; row < 8; row++ {
+			for x := 0; x < 8; x++ {
+				//flip the whole sprite, so the tiles of a tall sprite swap too
+				y := int(half)*8 + row
+				if isBitSet(entry.flags, 6) {
+					y = int(height) - 1 - y
+				}
+				column := x
+				if isBitSet(entry.flags, 5) {
+					column = 7 - x
+				}
+				colour := pixels[row][x]
+				if colour != 0 {
+					view.image.SetRGBA(left+column, top+y, gbppu.objPaletteColour(entry.flags, colour))
+				}
+			}
+		}
+	}
+}
+
+// get the sprite listed at a point
+func (view *oamView) spriteAt(x, y int) int {
+	return x/OAM_COLUMN_WIDTH*OAM_VIEW_ROWS + y/OAM_ROW_HEIGHT
+}
+
+func (view *oamView) describe(x, y int) string {
+	index := view.spriteAt(x, y)
+	if index >= OAM_ENTRIES {
+		return ""
+	}
+	return view.spriteDetail(readSprite(index), spriteHeight(gbppu.read(gbppu.LCDC)))
+}
+
+// describe a sprite in full
+func (view *oamView) spriteDetail(entry sprite, height uint16) string {
+	detail := fmt.Sprintf("sprite %d at 0x%04X: X %d Y %d tile 0x%02X flags 0x%02X (%s) %s",
+		entry.index, entry.address, entry.x, entry.y, entry.tile, entry.flags, entry.flagLetters(), entry.palette())
+	switch {
+	case entry.dropped(view.line, height):
+		detail += fmt.Sprintf(", dropped on line %d", view.line)
+	case entry.covers(view.line, height):
+		detail += fmt.Sprintf(", drawn on line %d", view.line)
+	}
+	if lines := entry.droppedLines(height); lines > 0 {
+		detail += fmt.Sprintf(", dropped on %d lines", lines)
+	}
+	return detail
+}
+
+// list all the sprites as text
+func (view *oamView) report() string {
+	height := spriteHeight(gbppu.read(gbppu.LCDC))
+	var report strings.Builder
+	fmt.Fprintf(&report, "%s frame %d, %dx%d sprites, checking line %d\n", gbrom.name(), gbppu.frameCount, 8, height, view.line)
+	for index := 0; index < OAM_ENTRIES; index++ {
+		report.WriteString(view.spriteDetail(readSprite(index), height))
+		report.WriteString("\n")
+	}
+	return report.String()
+}
+
+// save the list as text in dir, named like the other exports
+func (view *oamView) exportText(dir string) (string, error) {
+	name := fmt.Sprintf("%s_%s_%06d.txt", fileTitle(gbrom.name()), view.name(), gbppu.frameCount)
+	path := filepath.Join(dir, name)
+	return path, os.WriteFile(path, []byte(view.report()), 0644)
+}
+
+func (view *oamView) keys(win *pixelgl.Window) {
+	if win.JustPressed(pixelgl.KeyUp) || win.Repeated(pixelgl.KeyUp) {
+		view.line = (view.line + int(SCRHEIGHT) - 1) % int(SCRHEIGHT)
+	}
+	if win.JustPressed(pixelgl.KeyDown) || win.Repeated(pixelgl.KeyDown) {
+		view.line = (view.line + 1) % int(SCRHEIGHT)
+	}
+	if win.JustPressed(pixelgl.KeyT) {
+		path, err := view.exportText(gbconfig.ScreenshotDir)
+		if err != nil {
+			fmt.Printf("Unable to save OAM list: %v\n", err)
+			return
+		}
+		fmt.Printf("Saved %s\n", path)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+)
+
+// The DMG palette registers (BGP, OBP0, OBP1) map each 2-bit colour number
+// from the tile data onto one of four shades:
+// Bit	7-6	5-4	3-2	1-0
+// Col	3	2	1	0
+// Shade 0 is the lightest and shade 3 the darkest. The shade is then turned
+// into an RGB value by the selected colour scheme.
+
+type colourScheme struct {
+	name    string
+	colours [4]color.RGBA
+}
+
+var colourSchemes = []colourScheme{
+	{"DMG green", [4]color.RGBA{
+		{155, 188, 15, 255},
+		{139, 172, 15, 255},
+		{48, 98, 48, 255},
+		{15, 56, 15, 255},
+	}},
+	{"Pocket grey", [4]color.RGBA{
+		{196, 207, 161, 255},
+		{139, 149, 109, 255},
+		{77, 83, 60, 255},
+		{31, 31, 31, 255},
+	}},
+	{"Light", [4]color.RGBA{
+		{0, 181, 173, 255},
+		{0, 148, 140, 255},
+		{0, 99, 90, 255},
+		{0, 57, 49, 255},
+	}},
+}
+
+// index into colourSchemes of the scheme used for rendering
+var currentScheme int
+
+// get the shade (0-3) for a colour number using a palette register value
+func paletteShade(palette byte, colour byte) byte {
+	return (palette >> (colour * 2)) & 0b11
+}
+
+// get the RGB value of a shade in the current colour scheme
+func shadeColour(shade byte) color.RGBA {
+	return colourSchemes[currentScheme].colours[shade&0b11]
+}
+
+// map a colour number through a palette register (BGP, OBP0 or OBP1) to RGB
+func (gbppu *ppu) paletteColour(palette uint16, colour byte) color.RGBA {
+	return shadeColour(paletteShade(gbppu.read(palette), colour))
+}
+
+// switch to the next colour scheme, wrapping round to the first
+func nextColourScheme() {
+	currentScheme = (currentScheme + 1) % len(colourSchemes)
+	debugLog(fmt.Sprintf("Colour scheme is %s\n", colourSchemes[currentScheme].name), DEBUG_INFO)
+}
+
+// select a colour scheme by name (case insensitive)
+func selectColourScheme(name string) error {
+	for i, scheme := range colourSchemes {
+		if strings.EqualFold(scheme.name, name) {
+			currentScheme = i
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown colour scheme %q", name)
+}
+
+// add a user defined colour scheme, replacing any existing scheme of the same name
+func addColourScheme(name string, colours [4]color.RGBA) {
+	for i, scheme := range colourSchemes {
+		if strings.EqualFold(scheme.name, name) {
+			colourSchemes[i].colours = colours
+			return
+		}
+	}
+	colourSchemes = append(colourSchemes, colourScheme{name, colours})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/faiface/pixel/pixelgl"
+)
+
+// The palette viewer shows the palettes in use as swatches: BGP, OBP0 and
+// OBP1 on the DMG, or the 8 background and 8 object palettes in CGB palette
+// RAM. Click a swatch to select it, then edit it in place and the running
+// game picks the change up straight away:
+//   - DMG: click again, or press S, to step the shade (0-3) that colour maps to
+//   - CGB: R, G and B raise a channel (0-31), with shift to lower it
+
+const SWATCH_WIDTH = 28
+const SWATCH_HEIGHT = 18
+const PALETTE_LABEL_WIDTH = 40
+const PALETTE_VIEW_WIDTH = 330
+
+var SELECTED_COLOUR = color.RGBA{0xFF, 0xFF, 0x00, 0xFF}
+
+type paletteView struct {
+	//selected swatch: row is the palette (DMG: BGP, OBP0, OBP1; CGB: BG 0-7 then OBJ 0-7)
+	row, colour int
+	selected    bool
+	image       *image.RGBA
+}
+
+var gbpaletteview paletteView
+
+func (view *paletteView) name() string {
+	return "Palettes"
+}
+
+// get the number of palettes shown
+func (view *paletteView) rows() int {
+	if gbcgb.enabled {
+		return 16
+	}
+	return 3
+}
+
+func (view *paletteView) render() *image.RGBA {
+	height := (view.rows() + 1) * SWATCH_HEIGHT
+	if view.image == nil || view.image.Rect.Dy() != height {
+		view.image = image.NewRGBA(image.Rect(0, 0, PALETTE_VIEW_WIDTH, height))
+	}
+	fillRect(view.image, view.image.Rect, color.RGBA{0, 0, 0, 0xFF})
+	for row := 0; row < view.rows(); row++ {
+		top := row * SWATCH_HEIGHT
+		drawText(view.image, 2, top+2, view.paletteName(row), OAM_TEXT_COLOUR)
+		for colour := 0; colour < 4; colour++ {
+			left := PALETTE_LABEL_WIDTH + colour*SWATCH_WIDTH
+			swatch := image.Rect(left, top+1, left+SWATCH_WIDTH-2, top+SWATCH_HEIGHT-1)
+			if view.selected && row == view.row && colour == view.colour {
+				fillRect(view.image, swatch.Inset(-1), SELECTED_COLOUR)
+			}
+			fillRect(view.image, swatch, view.swatchColour(row, byte(colour)))
+		}
+		if !gbcgb.enabled {
+			//show the register value too
+			text := fmt.Sprintf("0x%02X", gbppu.read(view.register(row)))
+			drawText(view.image, PALETTE_LABEL_WIDTH+4*SWATCH_WIDTH+4, top+2, text, OAM_TEXT_COLOUR)
+		}
+	}
+	if view.selected {
+		drawText(view.image, 2, view.rows()*SWATCH_HEIGHT+2, view.swatchDetail(view.row, view.colour), OAM_TEXT_COLOUR)
+	}
+	return view.image
+}
+
+func (view *paletteView) paletteName(row int) string {
+	switch {
+	case !gbcgb.enabled:
+		return [3]string{"BGP", "OBP0", "OBP1"}[row]
+	case row < 8:
+		return fmt.Sprintf("BG%d", row)
+	}
+	return fmt.Sprintf("OBJ%d", row-8)
+}
+
+// get the DMG palette register shown on a row
+func (view *paletteView) register(row int) uint16 {
+	return [3]uint16{gbppu.BGP, gbppu.OBP0, gbppu.OBP1}[row]
+}
+
+// get the CGB palette RAM and palette number shown on a row
+func (view *paletteView) paletteRAM(row int) (*[64]byte, byte) {
+	if row < 8 {
+		return &gbcgb.bgPalette, byte(row)
+	}
+	return &gbcgb.objPalette, byte(row - 8)
+}
+
+func (view *paletteView) swatchColour(row int, colour byte) color.RGBA {
+	if gbcgb.enabled {
+		ram, palette := view.paletteRAM(row)
+		return rgb555(paletteRAMColour(ram, palette, colour))
+	}
+	return gbppu.paletteColour(view.register(row), colour)
+}
+
+// get the swatch at a point, if there is one
+func (view *paletteView) swatchAt(x, y int) (int, int, bool) {
+	row, colour := y/SWATCH_HEIGHT, (x-PALETTE_LABEL_WIDTH)/SWATCH_WIDTH
+	ok := x >= PALETTE_LABEL_WIDTH && row < view.rows() && colour < 4
+	return row, colour, ok
+}
+
+func (view *paletteView) swatchDetail(row, colour int) string {
+	if gbcgb.enabled {
+		ram, palette := view.paletteRAM(row)
+		value := paletteRAMColour(ram, palette, byte(colour))
+		return fmt.Sprintf("%s colour %d: 0x%04X R%d G%d B%d", view.paletteName(row), colour,
+			value, value&0x1F, value>>5&0x1F, value>>10&0x1F)
+	}
+	shade := paletteShade(gbppu.read(view.register(row)), byte(colour))
+	return fmt.Sprintf("%s colour %d: shade %d", view.paletteName(row), colour, shade)
+}
+
+func (view *paletteView) describe(x, y int) string {
+	row, colour, ok := view.swatchAt(x, y)
+	if !ok {
+		return ""
+	}
+	return view.swatchDetail(row, colour)
+}
+
+// select a swatch, or on the DMG step the shade of one already selected
+func (view *paletteView) click(x, y int) {
+	row, colour, ok := view.swatchAt(x, y)
+	if !ok {
+		return
+	}
+	if view.selected && row == view.row && colour == view.colour && !gbcgb.enabled {
+		view.stepShade()
+		return
+	}
+	view.row, view.colour, view.selected = row, colour, true
+}
+
+func (view *paletteView) keys(win *pixelgl.Window) {
+	if !view.selected {
+		return
+	}
+	if !gbcgb.enabled {
+		if win.JustPressed(pixelgl.KeyS) {
+			view.stepShade()
+		}
+		return
+	}
+	step := 1
+	if win.Pressed(pixelgl.KeyLeftShift) || win.Pressed(pixelgl.KeyRightShift) {
+		step = -1
+	}
+	for channel, key := range []pixelgl.Button{pixelgl.KeyR, pixelgl.KeyG, pixelgl.KeyB} {
+		if win.JustPressed(key) || win.Repeated(key) {
+			view.stepChannel(channel, step)
+		}
+	}
+}
+
+// move the selected DMG colour on to the next shade, writing the palette register
+func (view *paletteView) stepShade() {
+	register := view.register(view.row)
+	value := gbppu.read(register)
+	shade := (paletteShade(value, byte(view.colour)) + 1) & 3
+	setPaletteShade(register, byte(view.colour), shade)
+}
+
+// change one channel (0 red, 1 green, 2 blue) of the selected CGB colour,
+// wrapping round from 0 to 31
+func (view *paletteView) stepChannel(channel int, step int) {
+	ram, palette := view.paletteRAM(view.row)
+	value := paletteRAMColour(ram, palette, byte(view.colour))
+	shift := uint(channel * 5)
+	level := (int(value>>shift&0x1F) + step + 32) % 32
+	value = value&^(0x1F<<shift) | uint16(level)<<shift
+	setPaletteRAMColour(ram, palette, byte(view.colour), value)
+}
+
+// set the shade a colour number maps to in a DMG palette register
+func setPaletteShade(register uint16, colour byte, shade byte) {
+	shift := colour * 2
+	gbmmu.memory[register] = gbmmu.memory[register]&^(3<<shift) | (shade&3)<<shift
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// Post-processing imitates the real screens once the PPU has finished a
+// frame: the slow LCD response that leaves ghost images behind moving
+// objects (and which games rely on to make flickering sprites look
+// transparent), and the GBC screen's dull, bleeding colours that its
+// palettes were chosen for. Stages change the frame in place, in order
+
+type postStage interface {
+	process(frame *image.RGBA)
+}
+
+// the stages in use, set from the config and toggled with hotkeys
+var gbghosting = &ghosting{}
+var gbcorrection = &colourCorrection{}
+var postStages = []postStage{gbcorrection, gbghosting}
+
+// run the post-processing stages over a frame
+func postProcess(frame *image.RGBA) *image.RGBA {
+	for _, stage := range postStages {
+		stage.process(frame)
+	}
+	return frame
+}
+
+// ghosting blends each frame with what was on screen before, so a pixel
+// fades towards its new colour rather than changing at once. persistence is
+// how much of the previous frame is kept, from 0 (off) to below 1
+type ghosting struct {
+	enabled     bool
+	persistence float64
+	previous    []float64 //the last frame shown, as RGB values
+}
+
+const DEFAULT_PERSISTENCE = 0.5
+
+func (stage *ghosting) process(frame *image.RGBA) {
+	if !stage.enabled || stage.persistence <= 0 {
+		stage.previous = nil
+		return
+	}
+	if len(stage.previous) != len(frame.Pix) {
+		//nothing to blend with yet
+		stage.previous = make([]float64, len(frame.Pix))
+		for i, value := range frame.Pix {
+			stage.previous[i] = float64(value)
+		}
+		return
+	}
+	keep := math.Min(stage.persistence, 0.95)
+	for i, value := range frame.Pix {
+		if i%4 == 3 {
+			continue //leave alpha alone
+		}
+		blended := float64(value)*(1-keep) + stage.previous[i]*keep
+		stage.previous[i] = blended
+		frame.Pix[i] = uint8(math.Round(blended))
+	}
+}
+
+func (stage *ghosting) toggle() {
+	stage.enabled = !stage.enabled
+	if stage.enabled && stage.persistence <= 0 {
+		stage.persistence = DEFAULT_PERSISTENCE
+	}
+	fmt.Printf("LCD ghosting: %v\n", stage.enabled)
+}
+
+// colourCorrection maps the colours a CGB game asks for to what the GBC
+// screen actually showed. The matrix (from byuu's higan) mixes some of each
+// channel into the others, and is applied to linear light, with the screen
+// darker than sRGB to begin with. Only used on CGB hardware, as DMG colours
+// come from the colour scheme
+type colourCorrection struct {
+	enabled bool
+	lookup  map[[3]uint8][3]uint8 //corrected colours, as frames have few colours
+}
+
+// rows are output R, G, B; columns are input R, G, B, out of 32
+var GBC_CORRECTION = [3][3]float64{
+	{26, 4, 2},
+	{0, 24, 8},
+	{6, 4, 22},
+}
+
+// gamma of the GBC screen, and of the display the frame is shown on
+const GBC_GAMMA = 2.4
+const DISPLAY_GAMMA = 2.2
+
+func (stage *colourCorrection) process(frame *image.RGBA) {
+	if !stage.enabled || !gbcgb.enabled {
+		return
+	}
+	if stage.lookup == nil {
+		stage.lookup = make(map[[3]uint8][3]uint8)
+	}
+	for i := 0; i < len(frame.Pix); i += 4 {
+		pix := frame.Pix[i : i+3]
+		in := [3]uint8{pix[0], pix[1], pix[2]}
+		out, ok := stage.lookup[in]
+		if !ok {
+			out = correctColour(in)
+			stage.lookup[in] = out
+		}
+		copy(pix, out[:])
+	}
+}
+
+// correct one RGB colour for the GBC screen
+func correctColour(in [3]uint8) [3]uint8 {
+	var linear [3]float64
+	for n, value := range in {
+		linear[n] = math.Pow(float64(value)/255, GBC_GAMMA)
+	}
+	var out [3]uint8
+	for row, weights := range GBC_CORRECTION {
+		mixed := (weights[0]*linear[0] + weights[1]*linear[1] + weights[2]*linear[2]) / 32
+		out[row] = uint8(math.Round(math.Pow(math.Min(mixed, 1), 1/DISPLAY_GAMMA) * 255))
+	}
+	return out
+}
+
+func (stage *colourCorrection) toggle() {
+	stage.enabled = !stage.enabled
+	fmt.Printf("GBC colour correction: %v\n", stage.enabled)
+}
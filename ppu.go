@@ -1,32 +1,60 @@
 package main
 
 import (
+	"image"
 	"image/color"
-
-	"github.com/faiface/pixel"
-	"github.com/faiface/pixel/pixelgl"
-	"golang.org/x/image/colornames"
+	"sort"
+	"strings"
 )
 
-// Non-GBC colours
-// darkest green 11 - RGB: 15,56,15
-// dark green 10 - RGB: 48,98,48
-// light green 01 - RGB: 139,172,15
-// lightest green 00 - 155,188,15
+// Non-GBC colours are set by the palette registers and colour schemes in palette.go
+
+// the PPU draws into a plain frame buffer, one colour per pixel starting
+// at the top left. Completed frames are published through gbppu.sink
+type frameBuffer [SCRWIDTH * SCRHEIGHT]color.RGBA
 
-var gbscreen *pixel.PictureData
-var sprite *pixel.Sprite
-var gbColours [4]color.RGBA
+var gbscreen frameBuffer
+
+// colour number (0-3) of the background at each pixel of gbscreen, and the
+// CGB BG-to-OAM priority attribute, used for sprite priority
+var bgColour [SCRWIDTH * SCRHEIGHT]byte
+var bgPriority [SCRWIDTH * SCRHEIGHT]bool
 
 const SCRWIDTH uint16 = 160
 const SCRHEIGHT uint16 = 144
+const SCREEN_LINES byte = 144
+
+// sprite attribute table (OAM) holds 40 sprites of 4 bytes each
+const OAM_START uint16 = 0xFE00
+const OAM_END uint16 = 0xFEA0
+const SPRITES_PER_LINE = 10
 
 //const SCRWIDTH uint16 = 256
 //const SCRHEIGHT uint16 = 256
 
 //var sLogo string = "f000f000fc00fc00fc00fc00f300f3003c003c003c003c003c003c003c003c00f000f000f000f00000000000f300f300000000000000000000000000cf00cf00000000000f000f003f003f000f000f000000000000000000c000c0000f000f00000000000000000000000000f000f000000000000000000000000000f300f300000000000000000000000000c000c000030003000300030003000300ff00ff00c000c000c000c000c000c000c300c300000000000000000000000000fc00fc00f300f300f000f000f000f000f000f0003c003c00fc00fc00fc00fc003c003c00f300f300f300f300f300f300f300f300f300f300c300c300c300c300c300c300cf00cf00cf00cf00cf00cf00cf00cf003c003c003f003f003c003c000f000f003c003c00fc00fc0000000000fc00fc00fc00fc00f000f000f000f000f000f000f300f300f300f300f300f300f000f000c300c300c300c300c300c300ff00ff00cf00cf00cf00cf00cf00cf00c300c3000f000f000f000f000f000f00fc00fc003c004200b900a500b900a50042003c"
 
-//holds the ADDRESS of these registers, not the CONTENTS (which are in memory)
+var gbppu ppu
+
+// PPU modes, as reported in bits 0-1 of STAT
+const (
+	MODE_HBLANK byte = iota
+	MODE_VBLANK
+	MODE_OAM
+	MODE_DRAW
+)
+
+// PPU timings in dots (4194304 Hz, the CPU clock in normal speed)
+const DOTS_PER_LINE uint16 = 456
+const OAM_DOTS uint16 = 80
+const DRAW_DOTS uint16 = 172
+const LINES_PER_FRAME byte = 154
+const DOTS_PER_FRAME = uint64(DOTS_PER_LINE) * uint64(LINES_PER_FRAME)
+
+// dots per second
+const CLOCK_SPEED = 4194304
+
+// holds the ADDRESS of these registers, not the CONTENTS (which are in memory)
 type ppu struct {
 	LCDC        uint16 //FF40
 	STAT        uint16 //FF41
@@ -39,6 +67,20 @@ type ppu struct {
 	OBP1        uint16 //FF49 non-CGB
 	tilePattern uint16
 	tileMap     uint16
+	windowLine  uint16 //window row drawn by the scanline renderer, only advances on lines showing the window
+	mode        byte
+	dot         uint16 //position in the current line
+	offDots     uint64 //dots since the LCD was turned off or last showed a blank frame
+	frameReady  bool   //set when a frame has been completed, cleared once it is shown
+	//RENDER_SCANLINE or RENDER_FIFO, and the renderer for the line being drawn
+	renderer     byte
+	lineRenderer byte
+	//enforce VRAM and OAM access restrictions by mode (see access.go)
+	restrictAccess bool
+	frameCount     uint64    //frames completed since power on
+	sink           VideoSink //where completed frames are sent
+	image          *image.RGBA
+	shown          *image.RGBA //the last frame sent to the sink, after post-processing
 }
 
 func (gbppu *ppu) initialise() {
@@ -48,57 +90,140 @@ func (gbppu *ppu) initialise() {
 	gbppu.SCX = 0xFF43
 	gbppu.LY = 0xFF44
 	gbppu.LYC = 0xFF45
+	gbppu.BGP = 0xFF47
+	gbppu.OBP0 = 0xFF48
+	gbppu.OBP1 = 0xFF49
 	gbppu.tilePattern = 0x8000
 	gbppu.tileMap = 0x9800
+	gbppu.restrictAccess = !gbconfig.IgnoreAccessRestrictions
+	if strings.EqualFold(gbconfig.Renderer, "fifo") {
+		gbppu.renderer = RENDER_FIFO
+	}
+}
+
+// read a PPU register or OAM without using any CPU time
+func (gbppu *ppu) read(address uint16) byte {
+	return gbmmu.memory[address]
+}
+
+// advance the PPU by a number of dots, moving through the modes of each line:
+// OAM scan (mode 2), drawing (mode 3) and HBlank (mode 0) for lines 0-143,
+// then VBlank (mode 1) for lines 144-153
+func (gbppu *ppu) step(dots uint16) {
+	if !isBitSet(gbppu.read(gbppu.LCDC), 7) {
+		//LCD is off - LY is held at 0 in mode 0. The screen is blank, but
+		//blank frames still go out on time so the window keeps updating
+		gbppu.dot = 0
+		gbmmu.memory[gbppu.LY] = 0
+		gbppu.setMode(MODE_HBLANK)
+		gbppu.offDots += uint64(dots)
+		if gbppu.offDots >= DOTS_PER_FRAME {
+			gbppu.offDots -= DOTS_PER_FRAME
+			gbppu.blank()
+			gbppu.vblank()
+			gbppu.frameReady = true
+		}
+		return
+	}
+	gbppu.offDots = 0
+
+	for ; dots > 0; dots-- {
+		gbppu.dot++
+		ly := gbppu.read(gbppu.LY)
+		if ly < SCREEN_LINES {
+			switch {
+			case gbppu.dot == OAM_DOTS:
+				gbppu.setMode(MODE_DRAW)
+				//a change of renderer takes effect from the next line drawn
+				gbppu.lineRenderer = gbppu.renderer
+				if gbppu.lineRenderer == RENDER_FIFO {
+					gbfifo.startLine()
+				}
+			case gbppu.mode != MODE_DRAW:
+			case gbppu.lineRenderer == RENDER_FIFO:
+				//mode 3 lasts until the FIFO has pushed out all 160 pixels
+				if gbfifo.tick(&gbscreen) {
+					gbppu.endLine()
+				}
+			case gbppu.dot == OAM_DOTS+DRAW_DOTS:
+				gbppu.drawLine(&gbscreen)
+				gbppu.endLine()
+			}
+		}
+
+		if gbppu.dot == DOTS_PER_LINE {
+			gbppu.dot = 0
+			ly++
+			if ly == LINES_PER_FRAME {
+				ly = 0
+			}
+			gbmmu.memory[gbppu.LY] = ly
+			gbppu.compareLY()
+
+			switch {
+			case ly == SCREEN_LINES:
+				gbppu.setMode(MODE_VBLANK)
+				requestInterrupt(INT_VBLANK)
+				gbppu.vblank()
+				gbppu.frameReady = true
+			case ly < SCREEN_LINES:
+				gbppu.setMode(MODE_OAM)
+			}
+		}
+	}
+}
 
-	gbColours[0] = color.RGBA{155, 188, 15, 1}
-	//gbColours[0] = color.RGBA{0, 0, 0, 0}
-	gbColours[1] = color.RGBA{139, 172, 15, 0}
-	gbColours[2] = color.RGBA{48, 98, 48, 0}
-	gbColours[3] = color.RGBA{15, 56, 15, 0}
+// finish drawing the current line and start HBlank
+func (gbppu *ppu) endLine() {
+	gbppu.setMode(MODE_HBLANK)
+	gbhdma.hblank()
+}
+
+// update the mode in STAT, requesting a STAT interrupt if enabled for the new mode
+func (gbppu *ppu) setMode(mode byte) {
+	if gbppu.mode == mode {
+		return
+	}
+	gbppu.mode = mode
+	stat := gbppu.read(gbppu.STAT)
+	gbmmu.memory[gbppu.STAT] = stat&^0b11 | mode
 
-	gbscreen = pixel.MakePictureData(pixel.R(0, 0, float64(SCRWIDTH), float64(SCRHEIGHT)))
+	//STAT bits 3, 4 and 5 enable the interrupt for modes 0, 1 and 2
+	if mode != MODE_DRAW && isBitSet(stat, 3+int(mode)) {
+		requestInterrupt(INT_STAT)
+	}
+}
+
+// set the LY=LYC flag in STAT, requesting a STAT interrupt if enabled
+func (gbppu *ppu) compareLY() {
+	stat := gbppu.read(gbppu.STAT) &^ 0b100
+	if gbppu.read(gbppu.LY) == gbppu.read(gbppu.LYC) {
+		stat |= 0b100
+		if isBitSet(stat, 6) {
+			requestInterrupt(INT_STAT)
+		}
+	}
+	gbmmu.memory[gbppu.STAT] = stat
 }
 
-func (gbppu *ppu) drawLine(gbscreen *pixel.PictureData) {
-	last_pixel := uint16(len(gbscreen.Pix)-1) + 1
-	screenRow := uint16(gbmmu.fetchByte(gbppu.LY))
-	// calculate the number of pixels to subtract from the end of pixel array to get the current row start
-	row_start_disp := (screenRow + 1) * SCRWIDTH
-	bgRow := uint16(gbmmu.fetchByte(gbppu.SCY)) + screenRow
+func (gbppu *ppu) drawLine(gbscreen *frameBuffer) {
+	screenRow := uint16(gbppu.read(gbppu.LY))
+	bgRow := uint16(gbppu.read(gbppu.SCY)) + screenRow
 
 	//write 20*8 = 160 pixels for each row
 	tilePos := bgRow / 8 * 32
 	h_tile_start := (tilePos % 32) * 8
 	for i := uint16(0); i < 20; i++ {
-		tile := uint16(gbmmu.fetchByte(gbppu.tileMap+tilePos)) * 16
-		tileRowAddress := gbppu.tilePattern + (uint16(bgRow%8)*2 + tile)
-		byte1 := gbmmu.fetchByte(tileRowAddress)
-		byte2 := gbmmu.fetchByte(tileRowAddress + 1)
+		tile := uint16(gbppu.vramByte(0, gbppu.tileMap+tilePos))
+		attributes := gbppu.bgAttributes(gbppu.tileMap + tilePos)
 		//bin := fmt.Sprintf("%08b%08b", byte1, byte2)
 		//debugLog(fmt.Sprintf("%04x: %02x %02x: %s", tileRowAddress, byte1, byte2, bin))
 
-		pixelIndex := uint16(last_pixel) - row_start_disp + h_tile_start
+		pixelIndex := screenIndex(h_tile_start, screenRow)
 
 		//for all eight pixels of the tile row
-		for j := 0; j < 8; j++ {
-			//newByte1 := bits.RotateLeft8(byte1, -j) &^ 0b11111110
-			//newByte2 := bits.RotateLeft8(byte2, -j) &^ 0b11111110
-			var newByte1, newByte2 byte
-			if byte1|byte2 > 0 {
-				newByte1 = byte1 >> j &^ 0b11111110
-				newByte2 = byte2 >> j &^ 0b11111110
-				gbscreen.Pix[pixelIndex+(7-uint16(j))] = gbColours[int(newByte1)*2+int(newByte2)]
-			}
-
-			//colour := byte1 >> (6-j) + byte2 >> (8-j)
-
-			//bit_0, _ := strconv.Atoi(string(bin[j]))
-			//bit_1, _ := strconv.Atoi(string(bin[j+8]))
-			//todo - introduce palette functionality
-			//index := last_pixel - uint16(gbscreen.Index(pixel.V(float64(row), float64(i*8+j))))
-			//gbscreen.Pix[pixelIndex+uint16(j)] = gbColours[bit_0*2+bit_1]
-			//gbscreen.Pix[pixelIndex+(7-uint16(j))] = gbColours[int(newByte1)*2+int(newByte2)]
+		for j := uint16(0); j < 8; j++ {
+			gbppu.drawBgPixel(gbscreen, pixelIndex+j, LAYER_BG, gbppu.tilePattern+tile*16, attributes, bgRow%8, j)
 
 			//debugLog(fmt.Sprintf("Setting pixel at %d / %d\n", index, pixelIndex))
 		}
@@ -106,107 +231,277 @@ func (gbppu *ppu) drawLine(gbscreen *pixel.PictureData) {
 		h_tile_start += 8
 		//debugLog("\n")
 	}
+
+	gbppu.drawWindow(gbscreen, screenRow)
+	gbppu.drawSprites(gbscreen, screenRow)
 }
 
-//broken implementation of hblank
-func (gbppu *ppu) hblank(win *pixelgl.Window) {
-	//If LCD and PPU is enabled
-	if isBitSet(gbmmu.fetchByte(gbppu.LCDC), 7) {
-		//hblank after 63 clocks, but completes after 114 so need to change!
-		if tstates > 63 {
+// draw the window over the background from WX-7 to the end of the line,
+// once LY has reached WY. The window keeps its own line counter, so lines
+// where it is hidden don't skip any of its rows
+func (gbppu *ppu) drawWindow(gbscreen *frameBuffer, screenRow uint16) {
+	if screenRow == 0 {
+		gbppu.windowLine = 0
+	}
+	lcdc := gbppu.read(gbppu.LCDC)
+	wx := int(gbppu.read(WX)) - 7
+	if !isBitSet(lcdc, 5) || screenRow < uint16(gbppu.read(WY)) || wx >= int(SCRWIDTH) {
+		return
+	}
+	row := gbppu.windowLine
+	gbppu.windowLine++
 
-			gbmmu.storeByte(gbppu.LY, gbmmu.fetchByte(gbppu.LY)+1)
-			//fmt.Printf("In hblank. LY is %d, SCY is %d. Tstates=%d\n", gbmmu.fetchByte(gbppu.LY), gbmmu.fetchByte(gbppu.SCY), tstates)
-			if gbmmu.fetchByte(gbppu.LY) < 144 {
-				gbppu.drawLine(gbscreen)
-			}
-			tstates = 0
-			if gbmmu.fetchByte(gbppu.LY) == 144 {
-				//fmt.Printf("Calling vblank. LY is %d, SCY is %d. Tstates=%d\n", gbmmu.fetchByte(gbppu.LY), gbmmu.fetchByte(gbppu.SCY), tstates)
-				gbppu.vblank(win)
-			}
-		}
+	x := 0
+	if wx > 0 {
+		x = wx
+	}
+	for ; x < int(SCRWIDTH); x++ {
+		column := uint16(x - wx)
+		mapAddress := tileMapBase(lcdc, 6) + row/8*32 + column/8
+		tile := gbppu.vramByte(0, mapAddress)
+		attributes := gbppu.bgAttributes(mapAddress)
+		pixelIndex := screenIndex(uint16(x), screenRow)
+		gbppu.drawBgPixel(gbscreen, pixelIndex, LAYER_WINDOW, tileDataAddress(lcdc, tile, 0), attributes, row%8, column%8)
 	}
 }
 
-//draw the screen and update the window
-func (gbppu *ppu) vblank(win *pixelgl.Window) {
-	debugLog("In vblank\n", DEBUG_INFO)
-	//win.Clear(color.RGBA{155, 188, 15, 0})
-	win.Clear(colornames.Black)
-	sprite = pixel.NewSprite(gbscreen, gbscreen.Bounds())
-	sprite.Draw(win, pixel.IM.Moved(win.Bounds().Center()))
-	win.Update()
+// read VRAM from a given bank, regardless of the bank the CPU has selected
+func (gbppu *ppu) vramByte(bank byte, address uint16) byte {
+	return gbmmu.vram[bank][address-0x8000]
+}
 
-	// vblank operates from LY=144 to 153 and then resets
-	//if gbmmu.fetchByte(gbppu.LY) > 153 {
-	//	gbmmu.storeByte(gbppu.LY, 0)
-	//}
+// get the CGB attributes for a tile map entry. These are held in VRAM bank 1
+// at the same address as the tile number:
+// Bit	7	6	5	4	3	2-0
+//
+//	Prio	Y flip	X flip	-	Bank	Palette
+func (gbppu *ppu) bgAttributes(mapAddress uint16) byte {
+	if !gbcgb.active() {
+		return 0
+	}
+	return gbppu.vramByte(1, mapAddress)
 }
 
-func (gbppu *ppu) processTileMap(win *pixelgl.Window) {
-	//If LCD and PPU is enabled
-	if isBitSet(gbmmu.fetchByte(gbppu.LCDC), 7) {
-
-		LY := gbmmu.fetchByte(gbppu.LY) + 1
-		gbmmu.storeByte(gbppu.LY, LY)
-		//fmt.Printf("In hblank. LY is %d, SCY is %d. Tstates=%d\n", gbmmu.fetchByte(gbppu.LY), gbmmu.fetchByte(gbppu.SCY), tstates)
-		//if tstates > 63 {
-		if gbmmu.fetchByte(gbppu.LY) == 144 {
-			//fmt.Printf("vblank\n")
-
-			// loop for 32x32 tiles
-			scy := gbmmu.fetchByte(gbppu.SCY)
-			rowOffset := scy / 8
-			for f := uint16(0); f < 18; f++ {
-				for j := uint16(0); j < 20; j++ {
-					tileIndex := (32 * (f + uint16(rowOffset))) + j
-					var row = int(f)*8 - int(scy)%8
-					if row > 0 {
-						gbppu.showTilePattern(gbscreen, uint16(gbmmu.fetchByte(gbppu.tileMap+tileIndex)), tileIndex, uint16(row-1))
-					}
-				}
-			}
+// draw one pixel of a background or window tile starting at tileAddress. row
+// and x give the position of the pixel within the tile (before any flipping)
+func (gbppu *ppu) drawBgPixel(gbscreen *frameBuffer, pixelIndex uint16, layer int, tileAddress uint16, attributes byte, row, x uint16) {
+	bank := attributes >> 3 & 1
+	if isBitSet(attributes, 6) {
+		row = 7 - row
+	}
+	if isBitSet(attributes, 5) {
+		x = 7 - x
+	}
+	tileRowAddress := tileAddress + row*2
+	colour := tileColour(gbppu.vramByte(bank, tileRowAddress), gbppu.vramByte(bank, tileRowAddress+1), x)
+	if !gblayers.shown(layer) {
+		colour = 0
+	}
+
+	gbscreen[pixelIndex] = gblayers.tint(layer, gbppu.bgRGB(pixelIndex, attributes&7, colour))
+	bgColour[pixelIndex] = colour
+	bgPriority[pixelIndex] = isBitSet(attributes, 7)
+}
+
+// get the RGB value of a background colour number to draw at a pixel. The
+// SGB colours the shade later, by its position on screen
+func (gbppu *ppu) bgRGB(pixelIndex uint16, palette byte, colour byte) color.RGBA {
+	if gbsgb.enabled {
+		return gbsgb.plot(pixelIndex, paletteShade(gbppu.read(gbppu.BGP), colour))
+	}
+	return gbppu.bgPaletteColour(palette, colour)
+}
+
+// get the RGB value of a sprite colour number to draw at a pixel, using the
+// sprite's attribute flags
+func (gbppu *ppu) objRGB(pixelIndex uint16, flags byte, colour byte) color.RGBA {
+	if gbsgb.enabled {
+		return gbsgb.plot(pixelIndex, paletteShade(gbppu.read(gbppu.objPalette(flags)), colour))
+	}
+	return gbppu.objPaletteColour(flags, colour)
+}
+
+// get the RGB value of a background colour number in a palette. CGB games
+// use palette RAM, DMG games on a CGB map BGP through the compatibility palette
+func (gbppu *ppu) bgPaletteColour(palette byte, colour byte) color.RGBA {
+	switch {
+	case gbcgb.active():
+		return gbcgb.bgColour(palette, colour)
+	case gbcgb.compat:
+		return gbcgb.bgColour(0, paletteShade(gbppu.read(gbppu.BGP), colour))
+	}
+	return gbppu.paletteColour(gbppu.BGP, colour)
+}
+
+// get the RGB value of a sprite colour number using the sprite's attribute flags
+func (gbppu *ppu) objPaletteColour(flags byte, colour byte) color.RGBA {
+	palette := gbppu.objPalette(flags)
+	switch {
+	case gbcgb.active():
+		return gbcgb.objColour(flags&7, colour)
+	case gbcgb.compat:
+		return gbcgb.objColour(flags>>4&1, paletteShade(gbppu.read(palette), colour))
+	}
+	return gbppu.paletteColour(palette, colour)
+}
+
+// get the DMG palette register (OBP0 or OBP1) a sprite's flags select
+func (gbppu *ppu) objPalette(flags byte) uint16 {
+	if isBitSet(flags, 4) {
+		return gbppu.OBP1
+	}
+	return gbppu.OBP0
+}
+
+// get the colour number (0-3) of pixel x (0 is leftmost) in a tile row.
+// The first byte of the row holds the low bit of each pixel, the second the high bit
+func tileColour(byte1, byte2 byte, x uint16) byte {
+	bit := 7 - x
+	return (byte2>>bit&1)<<1 | byte1>>bit&1
+}
 
-			//fmt.Printf("Calling vblank. LY is %d, SCY is %d. Tstates=%d\n", gbmmu.fetchByte(gbppu.LY), gbmmu.fetchByte(gbppu.SCY), tstates)
-			gbppu.vblank(win)
+// get the index into gbscreen of a screen position
+func screenIndex(x, y uint16) uint16 {
+	return y*SCRWIDTH + x
+}
+
+// get the OAM addresses of the sprites shown on a screen row, in OAM order.
+// Only the first SPRITES_PER_LINE sprites that cover the row are used
+func (gbppu *ppu) scanOAM(screenRow uint16, height uint16) []uint16 {
+	//sprite Y is the screen row + 16
+	var visible []uint16
+	for address := OAM_START; address < OAM_END && len(visible) < SPRITES_PER_LINE; address += 4 {
+		y := uint16(gbppu.read(address))
+		if screenRow+16 >= y && screenRow+16 < y+height {
+			visible = append(visible, address)
 		}
 	}
+	return visible
 }
 
-func (gbppu *ppu) showTilePattern(gbscreen *pixel.PictureData, tile uint16, tilePos uint16, row uint16) {
-	//var row uint16 = uint16(tilePos/32) * 8
-	var h_tile_start uint16 = (tilePos % 32) * 8
-	var last_pixel uint16 = uint16(len(gbscreen.Pix)-1) + 1
+// get the sprite height (8 or 16) selected by LCDC bit 2
+func spriteHeight(lcdc byte) uint16 {
+	if isBitSet(lcdc, 2) {
+		return 16
+	}
+	return 8
+}
+
+// draw the sprites on a screen row over the background. Only the first
+// SPRITES_PER_LINE sprites in OAM that cover the row are shown
+func (gbppu *ppu) drawSprites(gbscreen *frameBuffer, screenRow uint16) {
+	lcdc := gbppu.read(gbppu.LCDC)
+	if !isBitSet(lcdc, 1) || !gblayers.shown(LAYER_OBJ) {
+		return
+	}
+	height := uint16(8)
+	if isBitSet(lcdc, 2) {
+		height = 16
+	}
 
-	//for all sixteen bytes of a tile (2 at a time)
-	address := gbppu.tilePattern + (tile * 16) - 2
-	for f := uint16(0); f < 16; f += 2 {
-		address += 2
-		byte1 := gbmmu.fetchByte(address)
-		byte2 := gbmmu.fetchByte(address + 1)
-		// calculate the number of pixels to subtract from the end of pixel array to get the current row start
-		var row_start_disp uint16 = (row + 1) * SCRWIDTH
-		pixelIndex := uint16(last_pixel) - row_start_disp + h_tile_start
-		if pixelIndex > 23040 {
-			pixelIndex += 0
+	visible := gbppu.scanOAM(screenRow, height)
+
+	//the sprite with the smallest X wins, then the one earliest in OAM,
+	//so draw in reverse priority order and let the winners overwrite.
+	//CGB games use OAM order only
+	if gbcgb.opri == 1 || !gbcgb.enabled {
+		sort.SliceStable(visible, func(i, j int) bool {
+			return gbppu.read(visible[i]+1) < gbppu.read(visible[j]+1)
+		})
+	}
+	//on the CGB, clearing LCDC bit 0 puts sprites above the background whatever the priority flags
+	bgMasterPriority := !gbcgb.active() || isBitSet(lcdc, 0)
+	for i := len(visible) - 1; i >= 0; i-- {
+		address := visible[i]
+		y := uint16(gbppu.read(address))
+		x := uint16(gbppu.read(address + 1))
+		tile := uint16(gbppu.read(address + 2))
+		flags := gbppu.read(address + 3)
+
+		row := screenRow + 16 - y
+		if isBitSet(flags, 6) {
+			row = height - 1 - row
+		}
+		if height == 16 {
+			tile &= 0xFE
+		}
+		var bank byte
+		if gbcgb.active() {
+			bank = flags >> 3 & 1
 		}
 
-		//for all eight pixels of a tile row
+		tileRowAddress := 0x8000 + tile*16 + row*2
+		byte1 := gbppu.vramByte(bank, tileRowAddress)
+		byte2 := gbppu.vramByte(bank, tileRowAddress+1)
 		for j := uint16(0); j < 8; j++ {
-			var newByte1, newByte2 byte
-			if byte1|byte2 > 0 {
-				newByte1 = byte1 >> j &^ 0b11111110
-				newByte2 = byte2 >> j &^ 0b11111110
+			screenX := x + j - 8
+			if x+j < 8 || screenX >= SCRWIDTH {
+				continue
+			}
+			pixelX := j
+			if isBitSet(flags, 5) {
+				pixelX = 7 - j
+			}
+			colour := tileColour(byte1, byte2, pixelX)
+			//colour 0 is transparent for sprites
+			if colour == 0 {
+				continue
 			}
-			//todo - introduce palette functionality
-			gbscreen.Pix[pixelIndex+(7-uint16(j))] = gbColours[int(newByte1)*2+int(newByte2)]
-			//debugLog(fmt.Sprintf("Setting pixel at %d\n", pixel))
+			pixelIndex := screenIndex(screenX, screenRow)
+			//priority flags put the sprite behind background colours 1-3
+			if bgMasterPriority && (isBitSet(flags, 7) || bgPriority[pixelIndex]) && bgColour[pixelIndex] != 0 {
+				continue
+			}
+			gbscreen[pixelIndex] = gblayers.tint(LAYER_OBJ, gbppu.objRGB(pixelIndex, flags, colour))
 		}
-		row++
-		if row >= SCRHEIGHT {
-			row = 0
+	}
+}
+
+// publish the completed frame to the video sink
+func (gbppu *ppu) vblank() {
+	debugLog("In vblank\n", DEBUG_INFO)
+	gbppu.frameCount++
+	if gbsgb.enabled {
+		gbsgb.vblank()
+	}
+	if gbppu.sink != nil {
+		frame := gbppu.frame()
+		if gbgbs.enabled {
+			gbgbs.drawInfo(frame)
+		}
+		gbppu.shown = postProcess(frame)
+		gbppu.sink.Present(gbppu.shown)
+	}
+
+	// vblank operates from LY=144 to 153 and then resets
+	//if gbppu.read(gbppu.LY) > 153 {
+	//	gbmmu.storeByte(gbppu.LY, 0)
+	//}
+}
+
+// clear the screen to what the LCD shows when it is off - white on the CGB,
+// the lightest shade on the DMG
+func (gbppu *ppu) blank() {
+	colour := shadeColour(0)
+	if gbcgb.enabled {
+		colour = color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}
+	}
+	for i := range gbscreen {
+		gbscreen[i] = colour
+	}
+}
+
+// the colour numbers (0-3) of an 8x8 tile, by row then column
+type tilePixels [8][8]byte
+
+// decode the tile whose data starts at address in a VRAM bank
+func (gbppu *ppu) decodeTile(bank byte, address uint16) tilePixels {
+	var pixels tilePixels
+	for row := uint16(0); row < 8; row++ {
+		byte1, byte2 := gbppu.vramByte(bank, address+row*2), gbppu.vramByte(bank, address+row*2+1)
+		for x := uint16(0); x < 8; x++ {
+			pixels[row][x] = tileColour(byte1, byte2, x)
 		}
-		//debugLog("\n")
 	}
+	return pixels
 }
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Recordings are frame exact: every frame the PPU completes is written once,
+// timed from the frame counter at the Game Boy's own frame rate of
+// CLOCK_SPEED / DOTS_PER_FRAME (about 59.73 Hz), whatever the host does
+
+// a video file format
+type frameEncoder interface {
+	addFrame(frame *image.RGBA) error
+	close() error
+}
+
+// recorder sends frames to an encoder. It is a VideoSink so it can sit
+// alongside the display in a multiSink
+type recorder struct {
+	path    string
+	encoder frameEncoder
+	display VideoSink //the sink in use before recording started
+	start   uint64    //frame counter when recording started
+	err     error
+}
+
+var gbrecorder *recorder
+
+// start recording to a file, choosing the format from the extension -
+// .gif, .png or .apng (animated PNG), or .y4m (raw video with a .wav alongside)
+func startRecording(path string) error {
+	if gbrecorder != nil {
+		return errors.New("already recording")
+	}
+	var encoder frameEncoder
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gif":
+		encoder, err = newGifEncoder(path)
+	case ".png", ".apng":
+		encoder, err = newApngEncoder(path)
+	case ".y4m":
+		encoder, err = newY4mEncoder(path)
+	default:
+		err = fmt.Errorf("unknown recording format %q", filepath.Ext(path))
+	}
+	if err != nil {
+		return err
+	}
+	gbrecorder = &recorder{path: path, encoder: encoder, display: gbppu.sink, start: gbppu.frameCount}
+	gbppu.sink = multiSink{gbrecorder.display, gbrecorder}
+	return nil
+}
+
+// stop recording and finish the file
+func stopRecording() error {
+	if gbrecorder == nil {
+		return nil
+	}
+	gbppu.sink = gbrecorder.display
+	err := gbrecorder.Close()
+	gbrecorder = nil
+	return err
+}
+
+func (gbrecorder *recorder) Present(frame *image.RGBA) {
+	//keep the first error, and stop encoding once there is one
+	if gbrecorder.err == nil {
+		gbrecorder.err = gbrecorder.encoder.addFrame(frame)
+	}
+}
+
+func (gbrecorder *recorder) Close() error {
+	return errors.Join(gbrecorder.err, gbrecorder.encoder.close())
+}
+
+// start or stop recording, naming the file from the ROM title and frame number
+func recordHotkey() {
+	if gbrecorder != nil {
+		frames := gbppu.frameCount - gbrecorder.start
+		path := gbrecorder.path
+		if err := stopRecording(); err != nil {
+			fmt.Printf("Unable to finish recording: %v\n", err)
+			return
+		}
+		fmt.Printf("Saved recording %s (%d frames)\n", path, frames)
+		return
+	}
+	format := gbconfig.RecordFormat
+	if format == "" {
+		format = "gif"
+	}
+	name := fmt.Sprintf("%s_%06d.%s", fileTitle(gbrom.name()), gbppu.frameCount, format)
+	if err := startRecording(filepath.Join(gbconfig.ScreenshotDir, name)); err != nil {
+		fmt.Printf("Unable to start recording: %v\n", err)
+		return
+	}
+	fmt.Printf("Recording to %s\n", name)
+}
+
+// gifEncoder keeps the frames and writes the GIF when closed, as the
+// standard library encoder needs them all at once. GIF delays are in
+// hundredths of a second and viewers slow anything under 2 down to 10, so
+// frames closer together than that are dropped. Delays are worked out from
+// the total time so far to stay in step (2 and 3 in turn, so about 40
+// frames a second)
+type gifEncoder struct {
+	path      string
+	anim      gif.GIF
+	frames    uint64 //frames added, including dropped ones
+	lastStart uint64 //time of the last frame kept, in hundredths of a second
+}
+
+// GIFs must not have delays shorter than this, in hundredths of a second
+const GIF_MIN_DELAY = 2
+
+func newGifEncoder(path string) (*gifEncoder, error) {
+	//create the file now so problems show up when recording starts
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return &gifEncoder{path: path}, nil
+}
+
+func (encoder *gifEncoder) addFrame(frame *image.RGBA) error {
+	now := frameTime(encoder.frames, 100)
+	encoder.frames++
+	if kept := len(encoder.anim.Image); kept > 0 {
+		if now-encoder.lastStart < GIF_MIN_DELAY {
+			return nil
+		}
+		encoder.anim.Delay[kept-1] = int(now - encoder.lastStart)
+	}
+	encoder.anim.Image = append(encoder.anim.Image, toPaletted(frame))
+	encoder.anim.Delay = append(encoder.anim.Delay, GIF_MIN_DELAY)
+	encoder.lastStart = now
+	return nil
+}
+
+func (encoder *gifEncoder) close() error {
+	//the last frame lasts until the end of the recording
+	if kept := len(encoder.anim.Image); kept > 0 {
+		if delay := int(frameTime(encoder.frames, 100) - encoder.lastStart); delay > GIF_MIN_DELAY {
+			encoder.anim.Delay[kept-1] = delay
+		}
+	}
+	file, err := os.Create(encoder.path)
+	if err != nil {
+		return err
+	}
+	if err := gif.EncodeAll(file, &encoder.anim); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// get the time in units (e.g. 100 for hundredths of a second) at the start of a frame
+func frameTime(frame uint64, units uint64) uint64 {
+	return frame * DOTS_PER_FRAME * units / CLOCK_SPEED
+}
+
+// convert a frame to a paletted image. Frames rarely have more than 256
+// colours, but if one does it is dithered to the web safe palette
+func toPaletted(frame *image.RGBA) *image.Paletted {
+	var colours color.Palette
+	seen := make(map[color.RGBA]bool)
+	for i := 0; i < len(frame.Pix); i += 4 {
+		c := color.RGBA{frame.Pix[i], frame.Pix[i+1], frame.Pix[i+2], frame.Pix[i+3]}
+		if !seen[c] {
+			seen[c] = true
+			colours = append(colours, c)
+		}
+	}
+	if len(colours) > 256 {
+		paletted := image.NewPaletted(frame.Bounds(), palette.WebSafe)
+		draw.FloydSteinberg.Draw(paletted, frame.Bounds(), frame, image.Point{})
+		return paletted
+	}
+	paletted := image.NewPaletted(frame.Bounds(), colours)
+	draw.Draw(paletted, frame.Bounds(), frame, image.Point{}, draw.Src)
+	return paletted
+}
+
+// apngEncoder writes an animated PNG. Each frame is encoded with the
+// standard PNG encoder and its image data repackaged as APNG frame chunks.
+// The frame count in the acTL chunk is filled in when the file is closed
+type apngEncoder struct {
+	file       *os.File
+	frames     uint32
+	sequence   uint32
+	actlOffset int64
+	ihdr       []byte
+}
+
+// APNG frame delay as a fraction of a second - DOTS_PER_FRAME/CLOCK_SPEED
+// does not fit in 16 bits, so this is the nearest with a 65535 denominator
+const APNG_DELAY_NUM = 1097
+const APNG_DELAY_DEN = 65535
+
+func newApngEncoder(path string) (*apngEncoder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &apngEncoder{file: file}, nil
+}
+
+// split PNG data into chunks of type and data
+func pngChunks(data []byte) ([][2][]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errors.New("not a PNG")
+	}
+	var chunks [][2][]byte
+	for data = data[len(signature):]; len(data) >= 12; {
+		length := binary.BigEndian.Uint32(data)
+		if int(length) > len(data)-12 {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		chunks = append(chunks, [2][]byte{data[4:8], data[8 : 8+length]})
+		data = data[12+length:]
+	}
+	return chunks, nil
+}
+
+func (encoder *apngEncoder) writeChunk(chunkType string, data []byte) error {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	_, err := encoder.file.Write(chunk)
+	return err
+}
+
+func (encoder *apngEncoder) addFrame(frame *image.RGBA) error {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, frame); err != nil {
+		return err
+	}
+	chunks, err := pngChunks(encoded.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if encoder.frames == 0 {
+		//the first frame sets the header for the whole animation
+		encoder.ihdr = chunks[0][1]
+		if _, err := encoder.file.Write([]byte("\x89PNG\r\n\x1a\n")); err != nil {
+			return err
+		}
+		if err := encoder.writeChunk("IHDR", encoder.ihdr); err != nil {
+			return err
+		}
+		encoder.actlOffset, _ = encoder.file.Seek(0, 1)
+		if err := encoder.writeChunk("acTL", encoder.actl()); err != nil {
+			return err
+		}
+	} else if !bytes.Equal(chunks[0][1], encoder.ihdr) {
+		return errors.New("APNG frames must all have the same format")
+	}
+
+	fctl := binary.BigEndian.AppendUint32(nil, encoder.sequence)
+	fctl = binary.BigEndian.AppendUint32(fctl, uint32(frame.Rect.Dx()))
+	fctl = binary.BigEndian.AppendUint32(fctl, uint32(frame.Rect.Dy()))
+	fctl = binary.BigEndian.AppendUint32(fctl, 0) //x offset
+	fctl = binary.BigEndian.AppendUint32(fctl, 0) //y offset
+	fctl = binary.BigEndian.AppendUint16(fctl, APNG_DELAY_NUM)
+	fctl = binary.BigEndian.AppendUint16(fctl, APNG_DELAY_DEN)
+	fctl = append(fctl, 0, 0) //no disposal or blending
+	encoder.sequence++
+	if err := encoder.writeChunk("fcTL", fctl); err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		if string(chunk[0]) != "IDAT" {
+			continue
+		}
+		//the first frame is the default image, the rest use fdAT chunks
+		if encoder.frames == 0 {
+			err = encoder.writeChunk("IDAT", chunk[1])
+		} else {
+			fdat := binary.BigEndian.AppendUint32(nil, encoder.sequence)
+			encoder.sequence++
+			err = encoder.writeChunk("fdAT", append(fdat, chunk[1]...))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	encoder.frames++
+	return nil
+}
+
+// animation control - frame count and number of plays (0 loops forever)
+func (encoder *apngEncoder) actl() []byte {
+	actl := binary.BigEndian.AppendUint32(nil, encoder.frames)
+	return binary.BigEndian.AppendUint32(actl, 0)
+}
+
+func (encoder *apngEncoder) close() error {
+	if encoder.frames > 0 {
+		if err := encoder.writeChunk("IEND", nil); err != nil {
+			encoder.file.Close()
+			return err
+		}
+		if _, err := encoder.file.Seek(encoder.actlOffset, 0); err != nil {
+			encoder.file.Close()
+			return err
+		}
+		if err := encoder.writeChunk("acTL", encoder.actl()); err != nil {
+			encoder.file.Close()
+			return err
+		}
+	}
+	return encoder.file.Close()
+}
+
+// y4mEncoder writes uncompressed YUV 4:4:4 video for external encoders,
+// with the sound recorded alongside in a WAV file of the same name, which
+// stays in step as both come from the same emulated clock. The frame rate is given
+// exactly as CLOCK_SPEED:DOTS_PER_FRAME
+type y4mEncoder struct {
+	file   *os.File
+	out    *bufio.Writer
+	audio  *audioRecorder
+	frames uint64
+	plane  []byte
+}
+
+func newY4mEncoder(path string) (*y4mEncoder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	audio, err := startAudioRecording(strings.TrimSuffix(path, filepath.Ext(path))+".wav", AUDIO_RATE_48K, false)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &y4mEncoder{file: file, out: bufio.NewWriter(file), audio: audio}, nil
+}
+
+func (encoder *y4mEncoder) addFrame(frame *image.RGBA) error {
+	width, height := frame.Rect.Dx(), frame.Rect.Dy()
+	if encoder.frames == 0 {
+		fmt.Fprintf(encoder.out, "YUV4MPEG2 W%d H%d F%d:%d Ip A1:1 C444\n", width, height, CLOCK_SPEED, DOTS_PER_FRAME)
+	}
+	encoder.out.WriteString("FRAME\n")
+
+	//Y, Cb and Cr planes in turn, BT.601 limited range
+	if len(encoder.plane) != width*height {
+		encoder.plane = make([]byte, width*height)
+	}
+	for plane := 0; plane < 3; plane++ {
+		for i := range encoder.plane {
+			pix := frame.Pix[(i/width)*frame.Stride+(i%width)*4:]
+			r, g, b := int(pix[0]), int(pix[1]), int(pix[2])
+			switch plane {
+			case 0:
+				encoder.plane[i] = byte((66*r+129*g+25*b+128)>>8 + 16)
+			case 1:
+				encoder.plane[i] = byte((-38*r-74*g+112*b+128)>>8 + 128)
+			case 2:
+				encoder.plane[i] = byte((112*r-94*g-18*b+128)>>8 + 128)
+			}
+		}
+		if _, err := encoder.out.Write(encoder.plane); err != nil {
+			return err
+		}
+	}
+	encoder.frames++
+	return nil
+}
+
+func (encoder *y4mEncoder) close() error {
+	return errors.Join(encoder.out.Flush(), encoder.file.Close(), stopAudioRecording(encoder.audio))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGifRecording(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.gif")
+	encoder, err := newGifEncoder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a second of frames, each a different shade
+	const FRAMES = 60
+	for n := 0; n < FRAMES; n++ {
+		frame := image.NewRGBA(image.Rect(0, 0, 160, 144))
+		for i := 0; i < len(frame.Pix); i += 4 {
+			frame.Pix[i], frame.Pix[i+1], frame.Pix[i+2], frame.Pix[i+3] = byte(n*4), 0, 0, 255
+		}
+		frame.Pix[0] = 255 //and a second colour
+		if err := encoder.addFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	anim, err := gif.DecodeAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for i, delay := range anim.Delay {
+		if delay < GIF_MIN_DELAY {
+			t.Errorf("frame %d has a delay of %d", i, delay)
+		}
+		total += delay
+	}
+	if want := int(frameTime(FRAMES, 100)); total != want {
+		t.Errorf("frames last %d hundredths, want %d", total, want)
+	}
+	if len(anim.Image) < FRAMES/2 || len(anim.Image) >= FRAMES {
+		t.Errorf("kept %d of %d frames", len(anim.Image), FRAMES)
+	}
+	last := anim.Image[len(anim.Image)-1]
+	if got := color.RGBAModel.Convert(last.At(1, 1)).(color.RGBA); got.R < byte((FRAMES-3)*4) {
+		t.Errorf("last frame is %v, want one of the last frames added", got)
+	}
+	if got := color.RGBAModel.Convert(last.At(0, 0)).(color.RGBA); got.R != 255 {
+		t.Errorf("corner is %v, want red", got)
+	}
+}
+
+func TestY4mRecordingUsesStride(t *testing.T) {
+	//a frame cut from a wider image, so rows don't follow on
+	wide := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	wide.SetRGBA(1, 1, color.RGBA{255, 255, 255, 255})
+	frame := wide.SubImage(image.Rect(0, 0, 2, 2)).(*image.RGBA)
+
+	path := filepath.Join(t.TempDir(), "test.y4m")
+	encoder, err := newY4mEncoder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.addFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Y plane after the headers - black is 16, white 235
+	luma := data[len(data)-3*4 : len(data)-2*4]
+	want := []byte{16, 16, 16, 235}
+	if string(luma) != string(want) {
+		t.Errorf("Y plane is %v, want %v", luma, want)
+	}
+}
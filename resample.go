@@ -0,0 +1,104 @@
+package main
+
+import "math"
+
+// The resampler converts the APU's stereo output to the host's sample rate.
+// It is band-limited: each output sample is a windowed sinc filter over the
+// input, cutting off below the output's Nyquist frequency so the pulse and
+// noise channels' harmonics don't alias into audible noise. The filter is
+// precomputed for RESAMPLE_PHASES positions between input samples
+
+const RESAMPLE_TAPS = 16 //input samples each side of the output position
+const RESAMPLE_PHASES = 256
+
+type resampler struct {
+	nominal  float64 //input samples per output sample
+	ratio    float64 //nominal, adjusted by rate control
+	position float64 //output position in input samples, from the start of input
+	input    []float32
+	kernels  [RESAMPLE_PHASES][2 * RESAMPLE_TAPS]float32
+}
+
+func newResampler(inputRate, outputRate int) *resampler {
+	r := &resampler{nominal: float64(inputRate) / float64(outputRate)}
+	r.ratio = r.nominal
+	r.position = RESAMPLE_TAPS - 1
+
+	//cut off a little below the lower of the two Nyquist frequencies,
+	//in cycles per input sample
+	cutoff := 0.45 * math.Min(1, 1/r.nominal)
+	for phase := range r.kernels {
+		fraction := float64(phase) / RESAMPLE_PHASES
+		sum := 0.0
+		var kernel [2 * RESAMPLE_TAPS]float64
+		for k := range kernel {
+			t := float64(k-RESAMPLE_TAPS+1) - fraction
+			kernel[k] = 2 * cutoff * sinc(2*cutoff*t) * blackman(t/RESAMPLE_TAPS)
+			sum += kernel[k]
+		}
+		//normalise so a steady level passes through unchanged
+		for k, value := range kernel {
+			r.kernels[phase][k] = float32(value / sum)
+		}
+	}
+	return r
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// Blackman window over -1 to 1
+func blackman(x float64) float64 {
+	if x <= -1 || x >= 1 {
+		return 0
+	}
+	return 0.42 + 0.5*math.Cos(math.Pi*x) + 0.08*math.Cos(2*math.Pi*x)
+}
+
+// set the rate adjustment, e.g. 1.001 to take input 0.1% faster
+func (r *resampler) adjust(factor float64) {
+	r.ratio = r.nominal * factor
+}
+
+// resample interleaved stereo input, appending 16-bit output to out
+func (r *resampler) process(in []float32, out []int16) []int16 {
+	r.input = append(r.input, in...)
+	frames := len(r.input) / 2
+	for {
+		centre := int(r.position)
+		if centre+RESAMPLE_TAPS >= frames {
+			break
+		}
+		kernel := &r.kernels[int((r.position-float64(centre))*RESAMPLE_PHASES)]
+		var left, right float32
+		first := (centre - RESAMPLE_TAPS + 1) * 2
+		for k, weight := range kernel {
+			left += r.input[first+k*2] * weight
+			right += r.input[first+k*2+1] * weight
+		}
+		out = append(out, toSample16(left), toSample16(right))
+		r.position += r.ratio
+	}
+	//keep only the input still needed for the filter
+	if drop := int(r.position) - RESAMPLE_TAPS + 1; drop > 0 {
+		r.input = append(r.input[:0], r.input[drop*2:]...)
+		r.position -= float64(drop)
+	}
+	return out
+}
+
+// convert -1 to 1 to a 16-bit sample, clipping anything outside
+func toSample16(value float32) int16 {
+	value *= 32767
+	if value > 32767 {
+		return 32767
+	}
+	if value < -32768 {
+		return -32768
+	}
+	return int16(value)
+}
@@ -3,17 +3,27 @@ package main
 import (
 	"bufio"
 	"encoding/hex"
-	"log"
 	"os"
+	"strings"
 )
 
 const rom_start = 0x0100
 
+// only the fixed 32KB of ROM is mapped until cartridge banking is implemented
+const rom_end = 0x8000
+
+var gbrom rom
+
 type rom struct {
 	entry    uint32
 	logo     []byte
 	title    [16]byte
 	man_code [4]byte
+	cgbFlag  byte
+	//SGB flag and old licensee code, which must both be set for SGB support
+	sgbFlag     byte
+	oldLicensee byte
+	path        string
 	//<todo>
 }
 
@@ -46,16 +56,19 @@ func (gbrom *rom) initialise() {
 //	}
 //}
 
-func (gbrom *rom) load() {
+// load the ROM into memory and read its header
+func (gbrom *rom) load() error {
 	var mem_pos = 0
 
 	// Open file and create scanner on top of it
 	//file, err := os.Open("Tetris (World).gb")
 	//file, err := os.Open("01-special.gb")
-	file, err := os.Open("02-interrupts.gb")
+	//file, err := os.Open("02-interrupts.gb")
+	file, err := os.Open(gbrom.path)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer file.Close()
 	scanner := bufio.NewScanner(file)
 
 	// Default scanner is bufio.ScanLines. Lets use ScanWords.
@@ -69,11 +82,16 @@ func (gbrom *rom) load() {
 			bootpage[mem_pos] = b[0]
 		}
 
-		if mem_pos >= rom_start {
+		if mem_pos >= rom_start && mem_pos < rom_end {
 			gbmmu.memory[mem_pos] = b[0]
 		}
 		mem_pos += 1
 	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	gbrom.parseHeader()
 
 	//success := scanner.Bytes()
 	//if success == false {
@@ -96,4 +114,31 @@ func (gbrom *rom) load() {
 	//	gbmmu.memory[mem_pos] = gbrom.logo[i]
 	//	mem_pos += 1
 	//}
+	return nil
+}
+
+// read the cartridge header details from 0x0134-0x0143
+func (gbrom *rom) parseHeader() {
+	copy(gbrom.title[:], gbmmu.memory[0x0134:0x0144])
+	copy(gbrom.man_code[:], gbmmu.memory[0x013F:0x0143])
+	gbrom.cgbFlag = gbmmu.memory[0x0143]
+	gbrom.sgbFlag = gbmmu.memory[SGB_FLAG_ADDRESS]
+	gbrom.oldLicensee = gbmmu.memory[OLD_LICENSEE_ADDRESS]
+}
+
+// get the game title. CGB cartridges use the end of the title area for
+// the manufacturer code and CGB flag, so stop at the first unprintable byte
+func (gbrom *rom) name() string {
+	end := len(gbrom.title)
+	if gbrom.cgbFlag == CGB_SUPPORTED || gbrom.cgbFlag == CGB_ONLY {
+		end = 15
+	}
+	var name strings.Builder
+	for _, c := range gbrom.title[:end] {
+		if c < 0x20 || c > 0x7E {
+			break
+		}
+		name.WriteByte(c)
+	}
+	return strings.TrimSpace(name.String())
 }
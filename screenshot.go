@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"path/filepath"
+	"strings"
+)
+
+// save the frame on screen as a PNG in dir, scaled up by a whole number
+// factor. The file is named from the ROM title and frame number, e.g.
+// TETRIS_000123.png. Returns the path written
+func saveScreenshot(dir string, scale int) (string, error) {
+	name := fmt.Sprintf("%s_%06d.png", fileTitle(gbrom.name()), gbppu.frameCount)
+	path := filepath.Join(dir, name)
+	if err := writePNG(path, scaleNearest(gbppu.shownFrame(), scale)); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// make a ROM title safe to use in a file name
+func fileTitle(title string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		}
+		return '_'
+	}, title)
+	if safe == "" {
+		return "gbemu"
+	}
+	return safe
+}
+
+// scale an image up by a whole number factor, repeating each pixel
+func scaleNearest(src *image.RGBA, scale int) *image.RGBA {
+	if scale <= 1 {
+		return src
+	}
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*scale, bounds.Dy()*scale))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			pix := src.Pix[src.PixOffset(bounds.Min.X+x, bounds.Min.Y+y):]
+			for dy := 0; dy < scale; dy++ {
+				offset := dst.PixOffset(x*scale, y*scale+dy)
+				for dx := 0; dx < scale; dx++ {
+					copy(dst.Pix[offset+dx*4:offset+dx*4+4], pix[:4])
+				}
+			}
+		}
+	}
+	return dst
+}
+
+// save a screenshot using the configured folder and scale, reporting the result
+func screenshotHotkey() {
+	scale := gbconfig.ScreenshotScale
+	if scale < 1 {
+		scale = 1
+	}
+	path, err := saveScreenshot(gbconfig.ScreenshotDir, scale)
+	if err != nil {
+		fmt.Printf("Unable to save screenshot: %v\n", err)
+		return
+	}
+	fmt.Printf("Saved screenshot %s\n", path)
+}
@@ -0,0 +1,24 @@
+package main
+
+// serial transfer data and control registers
+const SB uint16 = 0xFF01
+const SC uint16 = 0xFF02
+
+// With no link cable connected a transfer started by the Game Boy (SC bit 7
+// and internal clock bit 0 set) completes straight away, shifting in 0xFF.
+// Bytes sent are kept, as test ROMs report their results over serial
+type serial struct {
+	output []byte
+}
+
+var gbserial serial
+
+func (gbserial *serial) control(value byte) {
+	if value&0x81 != 0x81 {
+		return
+	}
+	gbserial.output = append(gbserial.output, gbmmu.memory[SB])
+	gbmmu.memory[SB] = 0xFF
+	gbmmu.memory[SC] = value &^ 0x80
+	requestInterrupt(INT_SERIAL)
+}
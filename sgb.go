@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+// Super Game Boy. SGB enhanced cartridges talk to the SNES by sending
+// 16 byte packets over the joypad select lines (P14 and P15 in P1), and bulk
+// data (palettes, border tiles) by putting it on screen and asking the SGB
+// to copy the next frame. The SGB colours the 160x144 picture using four
+// palettes chosen per 8x8 cell and shows it inside a 256x224 border
+
+const P1 uint16 = 0xFF00
+
+// cartridge header values for SGB support
+const SGB_FLAG_ADDRESS = 0x0146
+const SGB_SUPPORTED = 0x03
+const OLD_LICENSEE_ADDRESS = 0x014B
+const SGB_LICENSEE = 0x33
+
+// output frame size and where the Game Boy screen sits within it
+const SGB_WIDTH = 256
+const SGB_HEIGHT = 224
+const SGB_SCREEN_X = 48
+const SGB_SCREEN_Y = 40
+
+// the screen is coloured in 8x8 cells
+const SGB_COLUMNS = 20
+const SGB_ROWS = 18
+
+const SGB_PACKET_BITS = 128
+
+// size of a VRAM transfer and of the attribute files sent by ATTR_TRN
+const SGB_TRANSFER_SIZE = 0x1000
+const SGB_ATF_COUNT = 45
+const SGB_ATF_SIZE = 90
+
+// border tile map size in tiles
+const SGB_MAP_WIDTH = 32
+const SGB_MAP_HEIGHT = 28
+
+// command codes, the top 5 bits of the first byte of a packet
+const (
+	SGB_PAL01    = 0x00
+	SGB_PAL23    = 0x01
+	SGB_PAL03    = 0x02
+	SGB_PAL12    = 0x03
+	SGB_ATTR_BLK = 0x04
+	SGB_ATTR_LIN = 0x05
+	SGB_ATTR_DIV = 0x06
+	SGB_ATTR_CHR = 0x07
+	SGB_PAL_SET  = 0x0A
+	SGB_PAL_TRN  = 0x0B
+	SGB_MLT_REQ  = 0x11
+	SGB_CHR_TRN  = 0x13
+	SGB_PCT_TRN  = 0x14
+	SGB_ATTR_TRN = 0x15
+	SGB_ATTR_SET = 0x16
+	SGB_MASK_EN  = 0x17
+)
+
+// MASK_EN settings for the Game Boy screen
+const (
+	SGB_MASK_OFF = iota
+	SGB_MASK_FREEZE
+	SGB_MASK_BLACK
+	SGB_MASK_COLOUR0
+)
+
+type sgb struct {
+	enabled bool
+
+	//packet being received over P1
+	lines     byte //P14 and P15 as last written
+	receiving bool
+	bits      int
+	packet    [16]byte
+	command   []byte //the packets of a multi-packet command so far
+	packets   int    //number of packets in the command
+
+	//multiplayer (MLT_REQ)
+	players byte
+	player  byte
+
+	//colouring
+	palettes   [4][4]uint16   //RGB555, colour 0 is shared by all four
+	system     [512][4]uint16 //palettes sent by PAL_TRN for PAL_SET
+	attributes [SGB_COLUMNS * SGB_ROWS]byte
+	atf        [SGB_ATF_COUNT][SGB_ATF_SIZE]byte
+	mask       byte
+	shades     [SCRWIDTH * SCRHEIGHT]byte //the frame being drawn, as DMG shades
+	screen     [SCRWIDTH * SCRHEIGHT]color.RGBA
+
+	//border
+	tiles          [256][32]byte //SNES 4 bits per pixel tiles
+	borderMap      [SGB_MAP_WIDTH * SGB_MAP_HEIGHT]uint16
+	borderPalettes [4][16]uint16 //SNES palettes 4-7
+
+	//VRAM transfer to make, 0 for none, and the frame count after the
+	//frame it is taken from
+	transfer      byte
+	transferArg   byte
+	transferFrame uint64
+}
+
+var gbsgb sgb
+
+// the SGB's startup palette, used until the game sets its own
+var SGB_DEFAULT_PALETTE = [4]uint32{0xF8E8C8, 0xD89048, 0xA82820, 0x301850}
+
+// check the cartridge header for SGB support
+func (gbrom *rom) supportsSGB() bool {
+	return gbrom.sgbFlag == SGB_SUPPORTED && gbrom.oldLicensee == SGB_LICENSEE
+}
+
+// turn the SGB on for SGB cartridges, unless the model is "dmg" or CGB
+// hardware has been chosen
+func (gbsgb *sgb) initialise(model string, cartridgeSGB bool) {
+	*gbsgb = sgb{}
+	switch strings.ToLower(model) {
+	case "dmg", "cgb":
+		gbsgb.enabled = false
+	default:
+		gbsgb.enabled = cartridgeSGB && !gbcgb.enabled
+	}
+	gbsgb.lines = 0x30
+	gbsgb.players = 1
+	for p := range gbsgb.palettes {
+		for c, rgb := range SGB_DEFAULT_PALETTE {
+			gbsgb.palettes[p][c] = toRGB555(rgb24(rgb))
+		}
+	}
+}
+
+// get the size of the frames sent to the video sinks
+func outputSize() (int, int) {
+	if gbsgb.enabled {
+		return SGB_WIDTH, SGB_HEIGHT
+	}
+	return int(SCRWIDTH), int(SCRHEIGHT)
+}
+
+// handle a write to P1. A packet starts with a reset pulse (both lines low),
+// then each bit is a pulse on one line - P14 low for 0, P15 low for 1 -
+// with both lines high in between. The bits are sent lowest first and end
+// with a 0 stop bit
+func (gbsgb *sgb) writeP1(value byte) {
+	lines := value & 0x30
+	previous := gbsgb.lines
+	gbsgb.lines = lines
+	if lines == previous {
+		return
+	}
+	switch lines {
+	case 0x00:
+		gbsgb.receiving = true
+		gbsgb.bits = 0
+		gbsgb.packet = [16]byte{}
+	case 0x20, 0x10:
+		if !gbsgb.receiving || previous != 0x30 {
+			return
+		}
+		if gbsgb.bits == SGB_PACKET_BITS {
+			gbsgb.receiving = false
+			if lines == 0x20 {
+				gbsgb.receivePacket()
+			}
+			return
+		}
+		if lines == 0x10 {
+			gbsgb.packet[gbsgb.bits/8] |= 1 << (gbsgb.bits % 8)
+		}
+		gbsgb.bits++
+	case 0x30:
+		//in multiplayer mode, raising P15 moves on to the next joypad
+		if !gbsgb.receiving && gbsgb.players > 1 && previous&0x20 == 0 {
+			gbsgb.player = (gbsgb.player + 1) % gbsgb.players
+		}
+	}
+}
+
+// read P1 with the buttons selected on joypad 1. With both lines high and
+// multiplayer on, the low bits give the current joypad as 0xF minus its
+// number. Only joypad 1 is connected to the keyboard
+func (gbsgb *sgb) readP1(buttons byte) byte {
+	if gbsgb.lines == 0x30 && gbsgb.players > 1 {
+		return 0xC0 | gbsgb.lines | (0x0F - gbsgb.player)
+	}
+	if gbsgb.player != 0 {
+		buttons = 0x0F
+	}
+	return 0xC0 | gbsgb.lines | buttons&0x0F
+}
+
+// collect a packet, running the command once all its packets have arrived.
+// The low 3 bits of the first byte give the number of packets
+func (gbsgb *sgb) receivePacket() {
+	if len(gbsgb.command) == 0 {
+		gbsgb.packets = int(gbsgb.packet[0] & 7)
+		if gbsgb.packets == 0 {
+			return
+		}
+	}
+	gbsgb.command = append(gbsgb.command, gbsgb.packet[:]...)
+	if len(gbsgb.command) < gbsgb.packets*16 {
+		return
+	}
+	gbsgb.execute(gbsgb.command)
+	gbsgb.command = nil
+}
+
+func (gbsgb *sgb) execute(data []byte) {
+	command := data[0] >> 3
+	debugLog(fmt.Sprintf("SGB command %02X\n", command), DEBUG_INFO)
+	switch command {
+	case SGB_PAL01:
+		gbsgb.setPalettes(data, 0, 1)
+	case SGB_PAL23:
+		gbsgb.setPalettes(data, 2, 3)
+	case SGB_PAL03:
+		gbsgb.setPalettes(data, 0, 3)
+	case SGB_PAL12:
+		gbsgb.setPalettes(data, 1, 2)
+	case SGB_ATTR_BLK:
+		gbsgb.attrBlock(data)
+	case SGB_ATTR_LIN:
+		gbsgb.attrLine(data)
+	case SGB_ATTR_DIV:
+		gbsgb.attrDivide(data)
+	case SGB_ATTR_CHR:
+		gbsgb.attrCharacter(data)
+	case SGB_PAL_SET:
+		for p := range gbsgb.palettes {
+			gbsgb.palettes[p] = gbsgb.system[binary.LittleEndian.Uint16(data[1+p*2:])&0x1FF]
+		}
+		gbsgb.shareColour0()
+		if isBitSet(data[9], 7) {
+			gbsgb.applyATF(data[9] & 0x3F)
+		}
+		if isBitSet(data[9], 6) {
+			gbsgb.mask = SGB_MASK_OFF
+		}
+	case SGB_ATTR_SET:
+		gbsgb.applyATF(data[1] & 0x3F)
+		if isBitSet(data[1], 6) {
+			gbsgb.mask = SGB_MASK_OFF
+		}
+	case SGB_MASK_EN:
+		gbsgb.mask = data[1] & 3
+	case SGB_MLT_REQ:
+		gbsgb.players = [4]byte{1, 2, 4, 4}[data[1]&3]
+		gbsgb.player = 0
+	case SGB_PAL_TRN, SGB_CHR_TRN, SGB_PCT_TRN, SGB_ATTR_TRN:
+		//the data is taken from the next whole frame - the one after the
+		//frame being drawn, or the next one if this is VBlank
+		gbsgb.transfer = command
+		gbsgb.transferArg = data[1]
+		gbsgb.transferFrame = gbppu.frameCount + 2
+		if gbppu.mode == MODE_VBLANK {
+			gbsgb.transferFrame = gbppu.frameCount + 1
+		}
+	default:
+		//sound, SNES programs and the like are not supported
+		debugLog(fmt.Sprintf("Unsupported SGB command %02X\n", command), DEBUG_INFO)
+	}
+}
+
+// PAL01 and friends: colour 0 for all palettes, then colours 1-3 for two palettes
+func (gbsgb *sgb) setPalettes(data []byte, a, b int) {
+	gbsgb.palettes[0][0] = binary.LittleEndian.Uint16(data[1:])
+	for c := 1; c < 4; c++ {
+		gbsgb.palettes[a][c] = binary.LittleEndian.Uint16(data[1+c*2:])
+		gbsgb.palettes[b][c] = binary.LittleEndian.Uint16(data[7+c*2:])
+	}
+	gbsgb.shareColour0()
+}
+
+// colour 0 of palette 0 is used by every palette
+func (gbsgb *sgb) shareColour0() {
+	for p := range gbsgb.palettes {
+		gbsgb.palettes[p][0] = gbsgb.palettes[0][0]
+	}
+}
+
+// ATTR_BLK: set the palettes inside, on the edge of and outside rectangles.
+// Each data set is a control byte (bit 0 inside, bit 1 edge, bit 2 outside),
+// a palette byte (2 bits each for inside, edge, outside) and the corners
+func (gbsgb *sgb) attrBlock(data []byte) {
+	count := int(data[1] & 0x1F)
+	for set := 0; set < count && 2+set*6+6 <= len(data); set++ {
+		block := data[2+set*6:]
+		control := block[0] & 7
+		inside, edge, outside := block[1]&3, block[1]>>2&3, block[1]>>4&3
+		//setting just the inside or just the outside sets the edge to match
+		switch control {
+		case 1:
+			control, edge = 3, inside
+		case 4:
+			control, edge = 6, outside
+		}
+		x1, y1, x2, y2 := int(block[2]&0x1F), int(block[3]&0x1F), int(block[4]&0x1F), int(block[5]&0x1F)
+		for y := 0; y < SGB_ROWS; y++ {
+			for x := 0; x < SGB_COLUMNS; x++ {
+				within := x >= x1 && x <= x2 && y >= y1 && y <= y2
+				onEdge := within && (x == x1 || x == x2 || y == y1 || y == y2)
+				cell := &gbsgb.attributes[y*SGB_COLUMNS+x]
+				switch {
+				case onEdge && isBitSet(control, 1):
+					*cell = edge
+				case within && !onEdge && isBitSet(control, 0):
+					*cell = inside
+				case !within && isBitSet(control, 2):
+					*cell = outside
+				}
+			}
+		}
+	}
+}
+
+// ATTR_LIN: set the palette of whole rows or columns. Each byte gives the
+// line number, palette (bits 5-6) and whether it is a row (bit 7 set)
+func (gbsgb *sgb) attrLine(data []byte) {
+	count := int(data[1])
+	for i := 0; i < count && 2+i < len(data); i++ {
+		line, palette := int(data[2+i]&0x1F), data[2+i]>>5&3
+		if isBitSet(data[2+i], 7) {
+			if line < SGB_ROWS {
+				for x := 0; x < SGB_COLUMNS; x++ {
+					gbsgb.attributes[line*SGB_COLUMNS+x] = palette
+				}
+			}
+		} else if line < SGB_COLUMNS {
+			for y := 0; y < SGB_ROWS; y++ {
+				gbsgb.attributes[y*SGB_COLUMNS+line] = palette
+			}
+		}
+	}
+}
+
+// ATTR_DIV: split the screen at a row (bit 6 set) or column, with palettes
+// for either side of the line and the line itself
+func (gbsgb *sgb) attrDivide(data []byte) {
+	after, before, on := data[1]&3, data[1]>>2&3, data[1]>>4&3
+	rows := isBitSet(data[1], 6)
+	split := int(data[2] & 0x1F)
+	for y := 0; y < SGB_ROWS; y++ {
+		for x := 0; x < SGB_COLUMNS; x++ {
+			position := x
+			if rows {
+				position = y
+			}
+			palette := on
+			if position < split {
+				palette = before
+			} else if position > split {
+				palette = after
+			}
+			gbsgb.attributes[y*SGB_COLUMNS+x] = palette
+		}
+	}
+}
+
+// ATTR_CHR: set cell palettes one by one from a starting cell, left to right
+// (direction 0) or top to bottom, with 4 palettes to a byte, first in the top bits
+func (gbsgb *sgb) attrCharacter(data []byte) {
+	x, y := int(data[1]), int(data[2])
+	count := int(binary.LittleEndian.Uint16(data[3:]))
+	downwards := data[5] == 1
+	for i := 0; i < count && 6+i/4 < len(data) && x < SGB_COLUMNS && y < SGB_ROWS; i++ {
+		gbsgb.attributes[y*SGB_COLUMNS+x] = data[6+i/4] >> (6 - i%4*2) & 3
+		if downwards {
+			if y++; y == SGB_ROWS {
+				y, x = 0, x+1
+			}
+		} else if x++; x == SGB_COLUMNS {
+			x, y = 0, y+1
+		}
+	}
+}
+
+// set the cell palettes from an attribute file sent by ATTR_TRN
+func (gbsgb *sgb) applyATF(number byte) {
+	if int(number) >= SGB_ATF_COUNT {
+		return
+	}
+	for i := range gbsgb.attributes {
+		gbsgb.attributes[i] = gbsgb.atf[number][i/4] >> (6 - i%4*2) & 3
+	}
+}
+
+// record the shade drawn at a pixel, and get the DMG colour to draw there
+func (gbsgb *sgb) plot(pixelIndex uint16, shade byte) color.RGBA {
+	gbsgb.shades[pixelIndex] = shade
+	return shadeColour(shade)
+}
+
+// finish a frame: make any VRAM transfer that is due, then colour the
+// screen unless it is masked
+func (gbsgb *sgb) vblank() {
+	if gbsgb.transfer != 0 && gbppu.frameCount >= gbsgb.transferFrame {
+		gbsgb.vramTransfer(gbsgb.transfer, gbsgb.transferArg, gbsgb.transferData())
+		gbsgb.transfer = 0
+	}
+	if gbsgb.mask == SGB_MASK_FREEZE {
+		return
+	}
+	for i, shade := range gbsgb.shades {
+		cell := i/int(SCRWIDTH)/8*SGB_COLUMNS + i%int(SCRWIDTH)/8
+		var colour color.RGBA
+		switch gbsgb.mask {
+		case SGB_MASK_BLACK:
+			colour = color.RGBA{0, 0, 0, 255}
+		case SGB_MASK_COLOUR0:
+			colour = rgb555(gbsgb.palettes[0][0])
+		default:
+			colour = rgb555(gbsgb.palettes[gbsgb.attributes[cell]][shade])
+		}
+		gbsgb.screen[i] = colour
+	}
+}
+
+// read 4KB from the frame just drawn. The SGB sees the screen as 2 bit
+// tiles, 20 to a row, in the same format as Game Boy tile data
+func (gbsgb *sgb) transferData() []byte {
+	data := make([]byte, SGB_TRANSFER_SIZE)
+	for tile := 0; tile < SGB_TRANSFER_SIZE/16; tile++ {
+		tileX, tileY := tile%SGB_COLUMNS*8, tile/SGB_COLUMNS*8
+		for row := 0; row < 8; row++ {
+			var low, high byte
+			for x := 0; x < 8; x++ {
+				shade := gbsgb.shades[screenIndex(uint16(tileX+x), uint16(tileY+row))]
+				low |= (shade & 1) << (7 - x)
+				high |= (shade >> 1) << (7 - x)
+			}
+			data[tile*16+row*2] = low
+			data[tile*16+row*2+1] = high
+		}
+	}
+	return data
+}
+
+func (gbsgb *sgb) vramTransfer(command byte, arg byte, data []byte) {
+	switch command {
+	case SGB_PAL_TRN:
+		for p := range gbsgb.system {
+			for c := range gbsgb.system[p] {
+				gbsgb.system[p][c] = binary.LittleEndian.Uint16(data[p*8+c*2:])
+			}
+		}
+	case SGB_CHR_TRN:
+		//128 tiles, to the first or second half of the tile set
+		first := int(arg&1) * 128
+		for t := 0; t < 128; t++ {
+			copy(gbsgb.tiles[first+t][:], data[t*32:])
+		}
+	case SGB_PCT_TRN:
+		for i := range gbsgb.borderMap {
+			gbsgb.borderMap[i] = binary.LittleEndian.Uint16(data[i*2:])
+		}
+		for p := range gbsgb.borderPalettes {
+			for c := range gbsgb.borderPalettes[p] {
+				gbsgb.borderPalettes[p][c] = binary.LittleEndian.Uint16(data[0x800+p*32+c*2:])
+			}
+		}
+	case SGB_ATTR_TRN:
+		for n := range gbsgb.atf {
+			copy(gbsgb.atf[n][:], data[n*SGB_ATF_SIZE:])
+		}
+	}
+}
+
+// draw the border and the coloured Game Boy screen into a 256x224 frame.
+// Border colour 0 is transparent, showing SGB colour 0 behind
+func (gbsgb *sgb) draw(frame *image.RGBA) {
+	backdrop := rgb555(gbsgb.palettes[0][0])
+	for y := 0; y < SGB_HEIGHT; y++ {
+		for x := 0; x < SGB_WIDTH; x++ {
+			colour := backdrop
+			if index := gbsgb.borderColour(x, y); index != 0 {
+				palette := gbsgb.borderMap[y/8*SGB_MAP_WIDTH+x/8] >> 10 & 3
+				colour = rgb555(gbsgb.borderPalettes[palette][index])
+			}
+			frame.SetRGBA(x, y, colour)
+		}
+	}
+	for y := 0; y < int(SCRHEIGHT); y++ {
+		for x := 0; x < int(SCRWIDTH); x++ {
+			frame.SetRGBA(SGB_SCREEN_X+x, SGB_SCREEN_Y+y, gbsgb.screen[screenIndex(uint16(x), uint16(y))])
+		}
+	}
+}
+
+// get the colour number (0-15) of a border pixel. Map entries hold the tile
+// number in the low byte, the palette in bits 10-12 and X and Y flips in
+// bits 14 and 15. Tiles are SNES format: bit planes 0 and 1 interleaved by
+// row, then planes 2 and 3
+func (gbsgb *sgb) borderColour(x, y int) byte {
+	entry := gbsgb.borderMap[y/8*SGB_MAP_WIDTH+x/8]
+	tile := &gbsgb.tiles[entry&0xFF]
+	row, column := y%8, x%8
+	if isBitSet(byte(entry>>8), 7) {
+		row = 7 - row
+	}
+	if !isBitSet(byte(entry>>8), 6) {
+		column = 7 - column
+	}
+	var colour byte
+	for plane := 0; plane < 4; plane++ {
+		b := tile[plane/2*16+row*2+plane%2]
+		colour |= (b >> column & 1) << plane
+	}
+	return colour
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/faiface/pixel/pixelgl"
+)
+
+// The sound view shows an oscilloscope for each APU channel with what it
+// is playing alongside. 1-4 mute a channel (or click its row), and with
+// shift held solo it instead
+
+const SCOPE_WIDTH = 256
+const SOUND_ROW_HEIGHT = 64
+const SOUND_TEXT_WIDTH = 200
+
+var SCOPE_COLOUR = color.RGBA{0x30, 0xC0, 0x30, 0xFF}
+var SCOPE_MUTED_COLOUR = color.RGBA{0x80, 0x80, 0x80, 0xFF}
+var SCOPE_CENTRE_COLOUR = color.RGBA{0x30, 0x30, 0x30, 0xFF}
+
+type soundView struct {
+	image *image.RGBA
+}
+
+var gbsoundview soundView
+
+var CHANNEL_KEYS = [CHANNEL_COUNT]pixelgl.Button{pixelgl.Key1, pixelgl.Key2, pixelgl.Key3, pixelgl.Key4}
+
+func (view *soundView) name() string {
+	return "Sound"
+}
+
+func (view *soundView) render() *image.RGBA {
+	if view.image == nil {
+		view.image = image.NewRGBA(image.Rect(0, 0, SCOPE_WIDTH+SOUND_TEXT_WIDTH, SOUND_ROW_HEIGHT*CHANNEL_COUNT))
+	}
+	fillRect(view.image, view.image.Rect, color.RGBA{0, 0, 0, 0xFF})
+	for channel := 0; channel < CHANNEL_COUNT; channel++ {
+		top := channel * SOUND_ROW_HEIGHT
+		view.drawScope(channel, top)
+		for i, line := range view.readouts(channel) {
+			drawText(view.image, SCOPE_WIDTH+6, top+4+i*DEBUG_LINE_HEIGHT, line, OAM_TEXT_COLOUR)
+		}
+	}
+	return view.image
+}
+
+// draw a channel's trace, -1 at the bottom of its row and 1 at the top
+func (view *soundView) drawScope(channel int, top int) {
+	fillRect(view.image, image.Rect(0, top+1, SCOPE_WIDTH, top+SOUND_ROW_HEIGHT-1), OAM_BACKDROP)
+	fillRect(view.image, image.Rect(0, top+SOUND_ROW_HEIGHT/2, SCOPE_WIDTH, top+SOUND_ROW_HEIGHT/2+1), SCOPE_CENTRE_COLOUR)
+	colour := SCOPE_COLOUR
+	if !gbchannels.audible(channel) {
+		colour = SCOPE_MUTED_COLOUR
+	}
+	height := float32(SOUND_ROW_HEIGHT - 4)
+	previous := -1
+	for x, sample := range gbchannels.trace(channel, SCOPE_WIDTH) {
+		y := top + 2 + int((1-sample)/2*(height-1))
+		//join each point to the last so edges show as lines
+		from, to := y, y
+		if previous >= 0 && previous < y {
+			from = previous
+		} else if previous > y {
+			to = previous
+		}
+		fillRect(view.image, image.Rect(x, from, x+1, to+1), colour)
+		previous = y
+	}
+}
+
+// get the read-out lines for a channel
+func (view *soundView) readouts(channel int) []string {
+	status := gbapu.channelStatus(channel)
+	title := fmt.Sprintf("%d %s", channel+1, CHANNEL_NAMES[channel])
+	switch {
+	case gbchannels.muted[channel]:
+		title += " MUTED"
+	case gbchannels.soloed[channel]:
+		title += " SOLO"
+	}
+	if !status.enabled {
+		title += " off"
+	}
+	detail := ""
+	switch channel {
+	case CHANNEL_PULSE1, CHANNEL_PULSE2:
+		detail = "duty " + DUTY_NAMES[status.duty]
+	case CHANNEL_NOISE:
+		detail = "15 bit"
+		if status.narrow {
+			detail = "7 bit"
+		}
+	}
+	pan := "--"
+	if status.left {
+		pan = "L" + pan[1:]
+	}
+	if status.right {
+		pan = pan[:1] + "R"
+	}
+	return []string{
+		title,
+		fmt.Sprintf("%.1f Hz", status.frequency),
+		fmt.Sprintf("vol %2d  pan %s", status.volume, pan),
+		detail,
+	}
+}
+
+func (view *soundView) describe(x, y int) string {
+	return gbapu.describeChannel(y / SOUND_ROW_HEIGHT)
+}
+
+// clicking a channel mutes or unmutes it
+func (view *soundView) click(x, y int) {
+	gbchannels.toggleMute(y / SOUND_ROW_HEIGHT)
+}
+
+func (view *soundView) keys(win *pixelgl.Window) {
+	solo := win.Pressed(pixelgl.KeyLeftShift) || win.Pressed(pixelgl.KeyRightShift)
+	for channel, key := range CHANNEL_KEYS {
+		if !win.JustPressed(key) {
+			continue
+		}
+		if solo {
+			gbchannels.toggleSolo(channel)
+		} else {
+			gbchannels.toggleMute(channel)
+		}
+	}
+}
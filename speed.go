@@ -0,0 +1,57 @@
+package main
+
+import "fmt"
+
+// CGB speed switch register. Bit 0 arms a switch which happens on the next
+// STOP instruction, bit 7 is the current speed (1 = double)
+const KEY1 uint16 = 0xFF4D
+
+// the CPU is stopped for around 2050 M-cycles while the speed changes
+const SPEED_SWITCH_CYCLES uint16 = 8200
+
+type speed struct {
+	double bool
+	armed  bool
+}
+
+var gbspeed speed
+
+// get the number of PPU (and APU) dots for a number of CPU t-states. The
+// PPU always runs at 4194304 Hz, so in double speed it only advances one
+// dot for every two t-states. The timer divider runs from the CPU clock and
+// takes t-states directly
+func (gbspeed *speed) dots(cycles uint16) uint16 {
+	if gbspeed.double {
+		return cycles >> 1
+	}
+	return cycles
+}
+
+func (gbspeed *speed) readKEY1() byte {
+	value := byte(0x7E)
+	if gbspeed.double {
+		value |= 0x80
+	}
+	if gbspeed.armed {
+		value |= 0x01
+	}
+	return value
+}
+
+func (gbspeed *speed) writeKEY1(value byte) {
+	gbspeed.armed = value&1 == 1
+}
+
+// handle a STOP instruction. Returns true if it performed a speed switch
+func (gbspeed *speed) stop() bool {
+	if !gbcgb.active() || !gbspeed.armed {
+		return false
+	}
+	gbspeed.double = !gbspeed.double
+	gbspeed.armed = false
+	//STOP resets the divider, and the CPU is stopped while the clock settles
+	gbtimer.resetDIV()
+	tstates += SPEED_SWITCH_CYCLES
+	debugLog(fmt.Sprintf("Speed switch, double speed is %t\n", gbspeed.double), DEBUG_INFO)
+	return true
+}
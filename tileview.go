@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/faiface/pixel/pixelgl"
+)
+
+// The tile viewer shows all 384 tiles in VRAM (0x8000-0x97FF), 16 to a
+// row, with VRAM bank 1 alongside on the CGB. The P key steps through the
+// palettes to draw them with: BGP, OBP0 and OBP1 on the DMG, and the 8
+// background and 8 object palettes on the CGB
+
+const TILES_PER_BANK = 384
+const TILE_VIEW_COLUMNS = 16
+
+type tileView struct {
+	palette byte //CGB: 0-7 background, 8-15 object palettes. DMG: BGP, OBP0, OBP1
+	image   *image.RGBA
+}
+
+var gbtileview tileView
+
+func (view *tileView) name() string {
+	return "Tiles"
+}
+
+func (view *tileView) banks() int {
+	if gbcgb.active() {
+		return 2
+	}
+	return 1
+}
+
+func (view *tileView) render() *image.RGBA {
+	width := TILE_VIEW_COLUMNS * 8 * view.banks()
+	height := TILES_PER_BANK / TILE_VIEW_COLUMNS * 8
+	if view.image == nil || view.image.Rect.Dx() != width {
+		view.image = image.NewRGBA(image.Rect(0, 0, width, height))
+	}
+	for bank := 0; bank < view.banks(); bank++ {
+		for tile := 0; tile < TILES_PER_BANK; tile++ {
+			pixels := gbppu.decodeTile(byte(bank), 0x8000+uint16(tile)*16)
+			left := (bank*TILE_VIEW_COLUMNS + tile%TILE_VIEW_COLUMNS) * 8
+			top := tile / TILE_VIEW_COLUMNS * 8
+			for row := 0; row < 8; row++ {
+				for x := 0; x < 8; x++ {
+					view.image.SetRGBA(left+x, top+row, view.colour(pixels[row][x]))
+				}
+			}
+		}
+	}
+	return view.image
+}
+
+// get the colour to show a colour number in with the selected palette
+func (view *tileView) colour(colour byte) color.RGBA {
+	switch {
+	case gbcgb.active() && view.palette < 8:
+		return gbcgb.bgColour(view.palette, colour)
+	case gbcgb.active():
+		return gbcgb.objColour(view.palette-8, colour)
+	}
+	return gbppu.paletteColour([3]uint16{gbppu.BGP, gbppu.OBP0, gbppu.OBP1}[view.palette%3], colour)
+}
+
+// get the bank and number (0-383) of the tile at a point
+func (view *tileView) tileAt(x, y int) (byte, int) {
+	column := x / 8
+	bank := column / TILE_VIEW_COLUMNS
+	return byte(bank), y/8*TILE_VIEW_COLUMNS + column%TILE_VIEW_COLUMNS
+}
+
+// describe the tile at a point, with the number the tile maps use for it:
+// 0x00-0xFF from 0x8000, or -128 to 127 from 0x9000
+func (view *tileView) describe(x, y int) string {
+	bank, tile := view.tileAt(x, y)
+	detail := fmt.Sprintf("tile %d bank %d address 0x%04X", tile, bank, 0x8000+tile*16)
+	if tile < 0x100 {
+		detail += fmt.Sprintf(", number 0x%02X", tile)
+	}
+	if tile >= 0x80 {
+		detail += fmt.Sprintf(", signed number %d", int8(tile&0xFF))
+	}
+	return detail
+}
+
+func (view *tileView) keys(win *pixelgl.Window) {
+	if win.JustPressed(pixelgl.KeyP) {
+		palettes := byte(3)
+		if gbcgb.active() {
+			palettes = 16
+		}
+		view.palette = (view.palette + 1) % palettes
+		fmt.Printf("Tile viewer palette: %s\n", view.paletteName())
+	}
+}
+
+func (view *tileView) paletteName() string {
+	if !gbcgb.active() {
+		return [3]string{"BGP", "OBP0", "OBP1"}[view.palette%3]
+	}
+	if view.palette < 8 {
+		return fmt.Sprintf("BG %d", view.palette)
+	}
+	return fmt.Sprintf("OBJ %d", view.palette-8)
+}
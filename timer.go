@@ -0,0 +1,52 @@
+package main
+
+// divider register - the upper 8 bits of an internal 16 bit counter
+// incremented every t-state, so DIV counts at 16384 Hz (32768 Hz in CGB
+// double speed)
+const DIV uint16 = 0xFF04
+
+// timer modulo and control registers. TIMA itself is not counted yet, but
+// the GBS player reads these to work out how often to call a track's play
+// routine
+const TMA uint16 = 0xFF06
+const TAC uint16 = 0xFF07
+
+// t-states per TIMA increment for each TAC clock select value
+var TIMER_DIVIDERS = [4]uint64{1024, 16, 64, 256}
+
+type timer struct {
+	counter uint16
+}
+
+var gbtimer timer
+
+// advance the divider by a number of CPU t-states
+func (gbtimer *timer) step(cycles uint16) {
+	//the APU frame sequencer is clocked each time the sequencer bit goes from 1 to 0
+	period := uint32(2) << gbtimer.sequencerBit()
+	edges := (uint32(gbtimer.counter)+uint32(cycles))/period - uint32(gbtimer.counter)/period
+	gbtimer.counter += cycles
+	gbmmu.memory[DIV] = getmsb(gbtimer.counter)
+	for ; edges > 0; edges-- {
+		gbapu.frameSequencer()
+	}
+}
+
+// get the divider bit that clocks the APU frame sequencer at 512 Hz - bit 4
+// of DIV, or bit 5 in double speed
+func (gbtimer *timer) sequencerBit() uint16 {
+	if gbspeed.double {
+		return 13
+	}
+	return 12
+}
+
+// any write to DIV (or a STOP instruction) resets the whole counter, which
+// clocks the frame sequencer early if its bit was set
+func (gbtimer *timer) resetDIV() {
+	if gbtimer.counter>>gbtimer.sequencerBit()&1 == 1 {
+		gbapu.frameSequencer()
+	}
+	gbtimer.counter = 0
+	gbmmu.memory[DIV] = 0
+}
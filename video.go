@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"strings"
+
+	"github.com/faiface/pixel"
+	"github.com/faiface/pixel/pixelgl"
+	"golang.org/x/image/colornames"
+)
+
+// VideoSink receives each frame completed by the PPU. The frame image is
+// reused for the next frame, so a sink must copy anything it keeps
+type VideoSink interface {
+	Present(frame *image.RGBA)
+	Close() error
+}
+
+// get the frame buffer as an image, ready to send to a sink. This is the
+// PPU's output before post-processing, which happens in place once the frame
+// is presented
+func (gbppu *ppu) frame() *image.RGBA {
+	width, height := outputSize()
+	if gbppu.image == nil || gbppu.image.Rect.Dx() != width || gbppu.image.Rect.Dy() != height {
+		gbppu.image = image.NewRGBA(image.Rect(0, 0, width, height))
+	}
+	if gbsgb.enabled {
+		gbsgb.draw(gbppu.image)
+		return gbppu.image
+	}
+	for i, c := range gbscreen {
+		pix := gbppu.image.Pix[i*4 : i*4+4]
+		pix[0], pix[1], pix[2], pix[3] = c.R, c.G, c.B, c.A
+	}
+	return gbppu.image
+}
+
+// get the last frame sent to the sinks, post-processed as it was shown.
+// Before the first frame there is nothing shown yet, so this is the PPU's
+// unprocessed output
+func (gbppu *ppu) shownFrame() *image.RGBA {
+	if gbppu.shown == nil {
+		return gbppu.frame()
+	}
+	return gbppu.shown
+}
+
+// copy a frame so it can be kept after the PPU reuses it
+func copyFrame(frame *image.RGBA) *image.RGBA {
+	kept := image.NewRGBA(frame.Rect)
+	copy(kept.Pix, frame.Pix)
+	return kept
+}
+
+// pixelSink shows frames in a pixel window, centred and enlarged with the
+// current scaling filter
+type pixelSink struct {
+	win *pixelgl.Window
+}
+
+func newPixelSink(win *pixelgl.Window) *pixelSink {
+	return &pixelSink{win: win}
+}
+
+func (sink *pixelSink) Present(frame *image.RGBA) {
+	//PictureDataFromImage flips the image, as pixel pictures start at the bottom left
+	picture := pixel.PictureDataFromImage(applyFilter(frame))
+	sink.win.Clear(colornames.Black)
+	sprite := pixel.NewSprite(picture, picture.Bounds())
+	sprite.Draw(sink.win, pixel.IM.Moved(sink.win.Bounds().Center()))
+	sink.win.Update()
+}
+
+func (sink *pixelSink) Close() error {
+	sink.win.Destroy()
+	return nil
+}
+
+// headlessSink throws frames away, counting them
+type headlessSink struct {
+	frames uint64
+}
+
+func (sink *headlessSink) Present(frame *image.RGBA) {
+	sink.frames++
+}
+
+func (sink *headlessSink) Close() error {
+	return nil
+}
+
+// imageSink writes frames to PNG files, scaled up by a whole number factor.
+// If the path contains a %d verb every frame is written, numbered from 0;
+// otherwise only the last frame is written, when the sink is closed
+type imageSink struct {
+	path   string
+	scale  int
+	frames uint64
+	last   *image.RGBA
+}
+
+func newImageSink(path string, scale int) *imageSink {
+	return &imageSink{path: path, scale: scale}
+}
+
+func (sink *imageSink) Present(frame *image.RGBA) {
+	if strings.Contains(sink.path, "%") {
+		if err := writePNG(fmt.Sprintf(sink.path, sink.frames), scaleNearest(frame, sink.scale)); err != nil {
+			fmt.Printf("Unable to write frame: %v\n", err)
+		}
+	} else {
+		sink.last = copyFrame(frame)
+	}
+	sink.frames++
+}
+
+func (sink *imageSink) Close() error {
+	if sink.last == nil {
+		return nil
+	}
+	return writePNG(sink.path, scaleNearest(sink.last, sink.scale))
+}
+
+func writePNG(path string, img image.Image) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// captureSink keeps copies of the most recent frames in memory, for tests
+// and tools that compare emulator output
+type captureSink struct {
+	limit  int
+	frames []*image.RGBA
+}
+
+func newCaptureSink(limit int) *captureSink {
+	return &captureSink{limit: limit}
+}
+
+func (sink *captureSink) Present(frame *image.RGBA) {
+	sink.frames = append(sink.frames, copyFrame(frame))
+	if sink.limit > 0 && len(sink.frames) > sink.limit {
+		sink.frames = sink.frames[1:]
+	}
+}
+
+func (sink *captureSink) Close() error {
+	return nil
+}
+
+// get the most recent frame, or nil if none have been captured
+func (sink *captureSink) last() *image.RGBA {
+	if len(sink.frames) == 0 {
+		return nil
+	}
+	return sink.frames[len(sink.frames)-1]
+}
+
+// multiSink sends each frame to several sinks
+type multiSink []VideoSink
+
+func (sinks multiSink) Present(frame *image.RGBA) {
+	for _, sink := range sinks {
+		sink.Present(frame)
+	}
+}
+
+func (sinks multiSink) Close() error {
+	var errs []error
+	for _, sink := range sinks {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
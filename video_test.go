@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+)
+
+// a ROM that switches the background to the darkest shade and waits
+var DARK_ROM_CODE = []byte{
+	0x3E, 0xFF, 0xE0, 0x47, //ld a,$FF : ldh (BGP),a
+	0x3E, 0x91, 0xE0, 0x40, //ld a,$91 : ldh (LCDC),a
+	0x18, 0xFE, //jr -2
+}
+
+func TestCaptureSink(t *testing.T) {
+	quietLog(t)
+	gbrom.path = writeTestROM(t, DARK_ROM_CODE)
+	t.Cleanup(func() {
+		gbrom.path = ""
+	})
+	gbcpu := cpu{}
+	if err := powerOn(&gbcpu); err != nil {
+		t.Fatal(err)
+	}
+	sink := newCaptureSink(3)
+	gbppu.sink = sink
+
+	for gbppu.frameCount < 5 {
+		gbcpu.step()
+	}
+	if len(sink.frames) != 3 {
+		t.Fatalf("captured %d frames, want the last 3", len(sink.frames))
+	}
+	frame := sink.last()
+	if frame.Rect.Dx() != int(SCRWIDTH) || frame.Rect.Dy() != int(SCRHEIGHT) {
+		t.Fatalf("frame is %v", frame.Rect)
+	}
+	dark := shadeColour(3)
+	for y := 0; y < frame.Rect.Dy(); y++ {
+		for x := 0; x < frame.Rect.Dx(); x++ {
+			if frame.RGBAAt(x, y) != dark {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, frame.RGBAAt(x, y), dark)
+			}
+		}
+	}
+}
+
+// a ROM that shows a window of the darkest shade from 80,72 over a blank
+// background
+var WINDOW_ROM_CODE = []byte{
+	0xAF, 0xE0, 0x40, //xor a : ldh (LCDC),a
+	0x21, 0x10, 0x80, 0x3E, 0xFF, 0x06, 0x10, //ld hl,$8010 : ld a,$FF : ld b,16
+	0x22, 0x05, 0x20, 0xFC, //ld (hl+),a : dec b : jr nz,-4
+	0x21, 0x00, 0x9C, 0x16, 0x01, 0x01, 0x00, 0x04, //ld hl,$9C00 : ld d,1 : ld bc,$400
+	0x7A, 0x22, 0x0B, 0x78, 0xB1, 0x20, 0xF9, //ld a,d : ld (hl+),a : dec bc : ld a,b : or c : jr nz,-7
+	0x3E, 0x48, 0xE0, 0x4A, //ld a,72 : ldh (WY),a
+	0x3E, 0x57, 0xE0, 0x4B, //ld a,87 : ldh (WX),a
+	0x3E, 0xE4, 0xE0, 0x47, //ld a,$E4 : ldh (BGP),a
+	0x3E, 0xF1, 0xE0, 0x40, //ld a,$F1 : ldh (LCDC),a
+	0x18, 0xFE, //jr -2
+}
+
+func TestWindow(t *testing.T) {
+	quietLog(t)
+	gbrom.path = writeTestROM(t, WINDOW_ROM_CODE)
+	t.Cleanup(func() {
+		gbrom.path = ""
+		gblayers = layers{}
+	})
+	tests := []struct {
+		name     string
+		renderer byte
+		shown    bool
+	}{
+		{"scanline", RENDER_SCANLINE, true},
+		{"fifo", RENDER_FIFO, true},
+		{"scanline hidden", RENDER_SCANLINE, false},
+		{"fifo hidden", RENDER_FIFO, false},
+	}
+	for _, test := range tests {
+		gbcpu := cpu{}
+		if err := powerOn(&gbcpu); err != nil {
+			t.Fatal(err)
+		}
+		gbppu.renderer = test.renderer
+		gblayers.setShown(LAYER_WINDOW, test.shown)
+		sink := newCaptureSink(1)
+		gbppu.sink = sink
+		for gbppu.frameCount < 3 {
+			gbcpu.step()
+		}
+
+		frame := sink.last()
+		for y := 0; y < frame.Rect.Dy(); y++ {
+			for x := 0; x < frame.Rect.Dx(); x++ {
+				want := shadeColour(0)
+				if test.shown && x >= 80 && y >= 72 {
+					want = shadeColour(3)
+				}
+				if frame.RGBAAt(x, y) != want {
+					t.Fatalf("%s: pixel %d,%d is %v, want %v", test.name, x, y, frame.RGBAAt(x, y), want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// wavWriter streams 16-bit PCM to a WAV file, filling in the sizes in the
+// header when it is closed
+type wavWriter struct {
+	file     *os.File
+	channels int
+	samples  uint32 //sample frames written
+}
+
+func newWavWriter(path string, channels int, rate int) (*wavWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	writer := &wavWriter{file: file, channels: channels}
+	header := []byte("RIFF\x00\x00\x00\x00WAVEfmt ")
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	header = binary.LittleEndian.AppendUint16(header, 1) //PCM
+	header = binary.LittleEndian.AppendUint16(header, uint16(channels))
+	header = binary.LittleEndian.AppendUint32(header, uint32(rate))
+	header = binary.LittleEndian.AppendUint32(header, uint32(rate*channels*2))
+	header = binary.LittleEndian.AppendUint16(header, uint16(channels*2))
+	header = binary.LittleEndian.AppendUint16(header, 16)
+	header = append(header, "data\x00\x00\x00\x00"...)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return writer, nil
+}
+
+// write interleaved samples, one per channel for each sample frame
+func (writer *wavWriter) write(samples []int16) error {
+	data := make([]byte, 0, len(samples)*2)
+	for _, sample := range samples {
+		data = binary.LittleEndian.AppendUint16(data, uint16(sample))
+	}
+	writer.samples += uint32(len(samples) / writer.channels)
+	_, err := writer.file.Write(data)
+	return err
+}
+
+func (writer *wavWriter) close() error {
+	dataSize := writer.samples * uint32(writer.channels) * 2
+	sizes := []struct {
+		offset int64
+		value  uint32
+	}{{4, 36 + dataSize}, {40, dataSize}}
+	for _, size := range sizes {
+		if _, err := writer.file.WriteAt(binary.LittleEndian.AppendUint32(nil, size.value), size.offset); err != nil {
+			writer.file.Close()
+			return err
+		}
+	}
+	return writer.file.Close()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Audio recordings write the mixed stereo output to a WAV file, and
+// optionally each channel's part of the mix to its own WAV "stem", named
+// after the main file (song.wav, song_pulse1.wav, ...). Stems keep the
+// channel's panning and volume, so together they add up to the mix.
+// Recordings are resampled at exactly the nominal rate, whatever rate
+// control does to the sound being played
+
+type audioRecorder struct {
+	path      string
+	mix       *wavWriter
+	resampler *resampler
+	stems     [4]*wavWriter //nil unless recording stems
+	stemRates [4]*resampler
+	output    []int16
+	err       error
+}
+
+// the recordings in progress
+var audioRecorders []*audioRecorder
+
+// start recording sound to a WAV file, with per-channel stems if asked
+func startAudioRecording(path string, rate int, stems bool) (*audioRecorder, error) {
+	recorder := &audioRecorder{path: path, resampler: newResampler(APU_SAMPLE_RATE, rate)}
+	var err error
+	if recorder.mix, err = newWavWriter(path, 2, rate); err != nil {
+		return nil, err
+	}
+	if stems {
+		base := strings.TrimSuffix(path, filepath.Ext(path))
+		for n, name := range CHANNEL_NAMES {
+			recorder.stems[n], err = newWavWriter(fmt.Sprintf("%s_%s.wav", base, name), 2, rate)
+			if err != nil {
+				recorder.close()
+				return nil, err
+			}
+			recorder.stemRates[n] = newResampler(APU_SAMPLE_RATE, rate)
+		}
+	}
+	//hand on the sound from before the recording, which has no stems, so
+	//the recording starts at a block boundary with the stems in step
+	gbapu.flush()
+	if stems {
+		gbapu.keepStems = true
+	}
+	audioRecorders = append(audioRecorders, recorder)
+	return recorder, nil
+}
+
+// finish a recording, writing out the sound still in the APU
+func stopAudioRecording(recorder *audioRecorder) error {
+	gbapu.flush()
+	for i, r := range audioRecorders {
+		if r == recorder {
+			audioRecorders = append(audioRecorders[:i], audioRecorders[i+1:]...)
+			break
+		}
+	}
+	gbapu.keepStems = false
+	for _, r := range audioRecorders {
+		if r.stems[0] != nil {
+			gbapu.keepStems = true
+		}
+	}
+	return recorder.close()
+}
+
+// resample and write a block of APU output. Errors are kept for close
+func (recorder *audioRecorder) record(samples []float32, stems *[4][]float32) {
+	if recorder.err != nil {
+		return
+	}
+	recorder.output = recorder.resampler.process(samples, recorder.output[:0])
+	recorder.err = recorder.mix.write(recorder.output)
+	for n, writer := range recorder.stems {
+		if writer == nil || recorder.err != nil {
+			continue
+		}
+		recorder.output = recorder.stemRates[n].process(stems[n], recorder.output[:0])
+		recorder.err = writer.write(recorder.output)
+	}
+}
+
+func (recorder *audioRecorder) close() error {
+	errs := []error{recorder.err}
+	if recorder.mix != nil {
+		errs = append(errs, recorder.mix.close())
+	}
+	for _, writer := range recorder.stems {
+		if writer != nil {
+			errs = append(errs, writer.close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// the recording started with the hotkey or -wav
+var wavRecording *audioRecorder
+
+// start recording sound with the settings from the config or command line
+func startWavRecording(path string) error {
+	if wavRecording != nil {
+		return errors.New("already recording sound")
+	}
+	rate := gbconfig.AudioRate
+	if rate == 0 {
+		rate = AUDIO_RATE_48K
+	}
+	recorder, err := startAudioRecording(path, rate, wavStems || gbconfig.RecordStems)
+	if err != nil {
+		return err
+	}
+	wavRecording = recorder
+	return nil
+}
+
+func stopWavRecording() error {
+	if wavRecording == nil {
+		return nil
+	}
+	err := stopAudioRecording(wavRecording)
+	wavRecording = nil
+	return err
+}
+
+// start or stop recording sound, naming the file from the ROM title and frame number
+func wavHotkey() {
+	if wavRecording != nil {
+		path := wavRecording.path
+		if err := stopWavRecording(); err != nil {
+			fmt.Printf("Unable to finish sound recording: %v\n", err)
+			return
+		}
+		fmt.Printf("Saved sound recording %s\n", path)
+		return
+	}
+	name := fmt.Sprintf("%s_%06d.wav", fileTitle(gbrom.name()), gbppu.frameCount)
+	if err := startWavRecording(filepath.Join(gbconfig.ScreenshotDir, name)); err != nil {
+		fmt.Printf("Unable to start sound recording: %v\n", err)
+		return
+	}
+	fmt.Printf("Recording sound to %s\n", name)
+}